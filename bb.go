@@ -3,29 +3,119 @@
 package main
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"github.com/MattSimmons1/bb/parser"
 	"github.com/spf13/cobra"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 )
 
-// highlight bb syntax to preview how bb will interpret the input
-func Preview(input string) {
-	input = strings.Replace(input, "\\n", "\n", -1) // convert raw escaped chars to literals
+// convert raw escaped chars to literals
+func unescape(input string) string {
+	input = strings.Replace(input, "\\n", "\n", -1)
 	input = strings.Replace(input, "\\t", "\t", -1)
-	parser.Preview(input)
+	return input
 }
 
-// return bb input with each item classified
-func Syntax(input string) {
-	input = strings.Replace(input, "\\n", "\n", -1) // convert raw escaped chars to literals
-	input = strings.Replace(input, "\\t", "\t", -1)
+// read the argument as a file, or use it as the input if it isn't one
+func readInput(arg string) string {
+	data, err := ioutil.ReadFile(arg)
+	if err == nil {
+		return string(data)
+	}
+	return arg
+}
+
+// whether the argument is a file rather than the input itself
+func isFile(arg string) bool {
+	info, err := os.Stat(arg)
+	return err == nil && !info.IsDir()
+}
+
+// the directory that imports in the argument are relative to - the directory of the file if it is one
+func inputDir(arg string) string {
+	if isFile(arg) {
+		return filepath.Dir(arg)
+	}
+	return ""
+}
+
+// print errors to stderr and exit
+func exitWithErrors(errs parser.ErrorList) {
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "%s (%q)\n", e, e.Text)
+	}
+	os.Exit(1)
+}
 
-	data := parser.Syntax(input)
+// create a logger that writes to stderr in the given format, so that logs don't get mixed up with the output
+func NewLogger(format string) parser.Logger {
+	switch format {
+	case "text":
+		return parser.NewTextLogger(os.Stderr)
+	case "json":
+		return parser.NewJSONLogger(os.Stderr)
+	}
+	fmt.Fprintf(os.Stderr, "Unknown log format %q, expected text or json\n", format)
+	os.Exit(1)
+	return nil
+}
+
+// create a parser with the definitions loaded - bb, or a JSON or YAML file mapping each unit to its props
+func NewParser(definitions string, logger parser.Logger) *parser.Parser {
+	p := parser.NewParser()
+	p.Logger = logger
+	if isFile(definitions) {
+		p.DefinitionsName = definitions // for the origins of the types in bb defs
+	}
+	var define func(data []byte) error
+	switch strings.ToLower(filepath.Ext(definitions)) {
+	case ".json":
+		define = p.DefineJSON
+	case ".yaml", ".yml":
+		define = p.DefineYAML
+	}
+	if define != nil {
+		data, err := ioutil.ReadFile(definitions)
+		if err == nil {
+			err = define(data)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return p
+	}
+
+	if definitions != "" {
+		p.Dir = inputDir(definitions)
+		if errs := p.Define(unescape(readInput(definitions))); len(errs) > 0 {
+			fmt.Fprintln(os.Stderr, "Invalid definitions:")
+			exitWithErrors(errs)
+		}
+		p.Dir = ""
+	}
+	return p
+}
+
+// highlight bb syntax to preview how bb will interpret the input
+func Preview(p *parser.Parser, input string) {
+	p.Preview(unescape(input))
+}
+
+// return bb input with each item classified
+func Syntax(p *parser.Parser, input string) {
+	data := p.Syntax(unescape(input))
 
 	j, err := json.Marshal(data)
 	if err != nil {
@@ -35,21 +125,30 @@ func Syntax(input string) {
 	fmt.Println(string(j))
 }
 
-func Debug(input string) {
-	input = strings.Replace(input, "\\n", "\n", -1) // convert raw escaped chars to literals
-	input = strings.Replace(input, "\\t", "\t", -1)
-	parser.Debug(input)
+func Debug(p *parser.Parser, input string) {
+	p.Debug(unescape(input))
 }
 
-func Convert(input string, injectionMode bool) {
-	input = strings.Replace(input, "\\n", "\n", -1) // convert raw escaped chars to literals
-	input = strings.Replace(input, "\\t", "\t", -1)
+func Convert(p *parser.Parser, input string, injectionMode bool, isCSV bool) {
+	input = unescape(input)
 
-	data := make([]interface{}, 0)
+	var data []interface{}
+	var errs parser.ErrorList
 	if injectionMode {
-		data = parser.ParseInjectionMode(input)
+		data, errs = p.ParseInjectionMode(input)
 	} else {
-		data = parser.Parse(input)
+		data, errs = p.Parse(input)
+	}
+
+	if isCSV {
+		if err := WriteCSV(os.Stdout, data); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if len(errs) > 0 {
+			exitWithErrors(errs)
+		}
+		return
 	}
 
 	j, err := json.Marshal(data)
@@ -65,6 +164,119 @@ func Convert(input string, injectionMode bool) {
 	}
 
 	fmt.Println(result)
+
+	if len(errs) > 0 {
+		exitWithErrors(errs)
+	}
+}
+
+// print every type in effect after the definitions and imports in the input, as JSON or a table
+func Defs(p *parser.Parser, input string, name string, format string) {
+	types, errs := p.Types(unescape(input), name)
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetEscapeHTML(false) // keep '>' in scripts readable
+		if err := encoder.Encode(types); err != nil {
+			panic(err)
+		}
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "UNIT\tKIND\tORIGIN\tPROPS\tMODIFIERS\tNOTES")
+		for _, t := range types {
+			kind := "pre-defined"
+			if t.UserDefined {
+				kind = "user defined"
+			}
+			var notes []string
+			if t.Replaces != "" {
+				notes = append(notes, "replaces "+t.Replaces)
+			}
+			if len(t.Shadows) > 0 {
+				notes = append(notes, "shadows "+strings.Join(t.Shadows, " "))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", t.Unit, kind, t.Origin, describeProps(t),
+				strings.Join(t.Modifiers, " "), strings.Join(notes, ", "))
+		}
+		w.Flush()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format %q, expected json or table\n", format)
+		os.Exit(1)
+	}
+
+	if len(errs) > 0 {
+		exitWithErrors(errs)
+	}
+}
+
+// list the props of a type in one line, sorted by name - scripts are too long to show
+func describeProps(t parser.TypeInfo) string {
+	props := map[string]string{}
+	for k, v := range t.NumericalProps {
+		props[k] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	for k, v := range t.StringProps {
+		props[k] = strconv.Quote(v)
+	}
+	for k := range t.ScriptProps {
+		props[k] = "<script>"
+	}
+
+	names := make([]string, 0, len(props))
+	for k := range props {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for i, k := range names {
+		names[i] = k + ": " + props[k]
+	}
+	return strings.Join(names, ", ")
+}
+
+// WriteCSV writes the output of table mode as CSV. The output can be something other than rows if a transform
+// changed it, in which case nothing is written and an error is returned.
+func WriteCSV(out io.Writer, data []interface{}) error {
+	rows := make([][]interface{}, len(data))
+	width := 0
+	for i, item := range data {
+		row, ok := item.([]interface{})
+		if !ok {
+			return fmt.Errorf("can't write CSV: item %d of the output isn't a row", i)
+		}
+		rows[i] = row
+		if len(row) > width {
+			width = len(row)
+		}
+	}
+
+	w := csv.NewWriter(out)
+	for _, row := range rows {
+		record := make([]string, width) // pad short rows so that every record has the same number of fields
+		for i, cell := range row {
+			switch value := cell.(type) {
+			case nil:
+				// empty
+			case string:
+				record[i] = value
+			case float64:
+				record[i] = strconv.FormatFloat(value, 'f', -1, 64)
+			case bool:
+				record[i] = strconv.FormatBool(value)
+			default:
+				j, err := json.Marshal(value)
+				if err != nil {
+					return err
+				}
+				record[i] = string(j)
+			}
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
 }
 
 func main() {
@@ -73,7 +285,16 @@ func main() {
 		var IsPreview bool
 		var IsDebug bool
 		var IsVerbose bool
+		var logFormat string
+		var isStrict bool
+		var noScripts bool
+		var noFileImports bool
+		var restrictImports bool
+		var withSource bool
+		var scriptTimeout time.Duration
 		var isInjectionMode bool
+		var isTable bool
+		var isCSV bool
 		var definitionsFile string
 
 		rootCmd = &cobra.Command{
@@ -86,38 +307,32 @@ func main() {
 					return
 				}
 
-				input := ""
-
-				// try to open argument as a file
-				data, err := ioutil.ReadFile(args[0])
-				if err == nil {
-					input = string(data)
-				} else {
-					input = args[0]
-				}
-
-				// try to open definitions as a file - prepend to the input
-				definitionsData, err := ioutil.ReadFile(definitionsFile)
-				if err == nil {
-					input = string(definitionsData) + "\n" + input
-				} else {
-					input = definitionsFile + "\n" + input
-				}
-
+				var logger parser.Logger
 				if IsVerbose {
-					parser.SetVerbose()
+					logger = NewLogger(logFormat)
 				}
 
+				input := readInput(args[0])
+				p := NewParser(definitionsFile, logger)
+				p.Dir = inputDir(args[0])
+				p.Table = isTable || isCSV
+				p.Strict = isStrict
+				p.NoScripts = noScripts
+				p.NoFileImports = noFileImports
+				p.RestrictImports = restrictImports
+				p.Source = withSource
+				p.ScriptTimeout = scriptTimeout
+
 				if IsDebug {
-					Debug(input)
+					Debug(p, input)
 					return
 				}
 
 				if IsPreview {
-					Preview(input)
+					Preview(p, input)
 					return
 				}
-				Convert(input, isInjectionMode)
+				Convert(p, input, isInjectionMode, isCSV)
 				return
 			},
 		}
@@ -146,36 +361,58 @@ func main() {
 						return
 					}
 
-					input := ""
-
-					// try to open argument as a file
-					data, err := ioutil.ReadFile(args[0]) // TODO: refactor
-					if err == nil {
-						input = string(data)
-					} else {
-						input = args[0]
+					var logger parser.Logger
+					if IsVerbose {
+						logger = NewLogger(logFormat)
 					}
 
-					// try to open definitions as a file - prepend to the input
-					definitionsData, err := ioutil.ReadFile(definitionsFile)
-					if err == nil {
-						input = string(definitionsData) + "\n" + input
-					} else {
-						input = definitionsFile + "\n" + input
+					p := NewParser(definitionsFile, logger)
+					p.Dir = inputDir(args[0])
+					Syntax(p, readInput(args[0]))
+				},
+			}
+			return
+		}())
+
+		rootCmd.AddCommand(func() (createCmd *cobra.Command) {
+			var format string
+			createCmd = &cobra.Command{
+				Use:   "defs",
+				Short: "List every type in effect after the definitions and imports in the input, with its props and where it was defined",
+				Run: func(c *cobra.Command, args []string) {
+					if len(args) < 1 {
+						err := c.Help()
+						if err != nil {
+							panic(err)
+						}
+						return
 					}
 
+					var logger parser.Logger
 					if IsVerbose {
-						parser.SetVerbose()
+						logger = NewLogger(logFormat)
 					}
 
-					Syntax(input)
+					p := NewParser(definitionsFile, logger)
+					p.Dir = inputDir(args[0])
+					name := ""
+					if p.Dir != "" {
+						name = args[0]
+					}
+					Defs(p, readInput(args[0]), name, format)
 				},
 			}
+			createCmd.Flags().StringVar(&format, "format", "json", "output format: json, or table")
+			createCmd.Flags().StringVarP(&definitionsFile, "definitions", "d", "",
+				"string or file path for additional type definitions - see bb --help")
 			return
 		}())
 
 		rootCmd.PersistentFlags().BoolVarP(&IsVerbose, "verbose", "v", false,
-			"show detailed logs from the bb lexer and parser")
+			"show detailed logs from the bb lexer and parser on stderr")
+
+		rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text",
+			"format of the logs shown with --verbose: text, or json for one JSON object per line")
 
 		rootCmd.Flags().BoolVarP(&IsPreview, "preview", "p", false,
 			"view the interpretation of the input without converting")
@@ -186,8 +423,32 @@ func main() {
 		rootCmd.Flags().BoolVarP(&isInjectionMode, "injection-mode", "i", false,
 			"convert bb within comment strings of another language")
 
+		rootCmd.Flags().BoolVarP(&isTable, "table", "t", false,
+			"convert each line to a row, with cells separated by tabs or two or more spaces")
+
+		rootCmd.Flags().BoolVar(&isCSV, "csv", false,
+			"convert each line to a row like --table, and print the rows as CSV")
+
+		rootCmd.Flags().BoolVar(&isStrict, "strict", false,
+			"report values that can't be converted as errors, e.g. script props that fail, instead of using null")
+
+		rootCmd.Flags().BoolVar(&noScripts, "no-scripts", false,
+			"don't run script props - keep them as strings, or report them as errors with --strict")
+
+		rootCmd.Flags().BoolVar(&noFileImports, "no-file-imports", false,
+			"report imports of files in the input as errors, e.g. for bb from an untrusted source")
+
+		rootCmd.Flags().BoolVar(&restrictImports, "restrict-imports", false,
+			"only allow imports of files in the input's directory or its subdirectories")
+
+		rootCmd.Flags().BoolVar(&withSource, "source", false,
+			"add the raw text, line, column, and offset of each UDT to its value as _source")
+
+		rootCmd.Flags().DurationVar(&scriptTimeout, "script-timeout", time.Second,
+			"how long each script prop can run for before it fails, or 0 for no limit")
+
 		rootCmd.Flags().StringVarP(&definitionsFile, "definitions", "d", "",
-			"string or file path for additional type definitions to be used when parsing")
+			"string or file path for additional type definitions to be used when parsing - bb, or a .json or .yaml file mapping each unit to its props")
 
 		return
 	}().Execute(); err != nil {
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_WriteCSV(t *testing.T) {
+	var out bytes.Buffer
+	rows := []interface{}{[]interface{}{"a", 1.5, true}, []interface{}{nil, map[string]interface{}{"b": 2.0}}}
+	if err := WriteCSV(&out, rows); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "a,1.5,true\n,\"{\"\"b\"\":2}\",\n"; out.String() != expected {
+		t.Errorf("got %q, expected %q", out.String(), expected)
+	}
+
+	// a transform can return something other than rows
+	out.Reset()
+	if err := WriteCSV(&out, []interface{}{[]interface{}{"a"}, 1.0}); err == nil {
+		t.Error("expected an error for output that isn't rows")
+	}
+	if out.Len() > 0 {
+		t.Errorf("expected nothing to be written, got %q", out.String())
+	}
+}
@@ -3,7 +3,8 @@ module github.com/MattSimmons1/bb
 go 1.16
 
 require (
-	github.com/robertkrimen/otto v0.0.0-20211024170158-b87d35c0b86f
+	github.com/BurntSushi/toml v1.3.2
+	github.com/dop251/goja v0.0.0-20231027120936-b396bb4c349d
 	github.com/spf13/cobra v1.3.0
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,269 @@
+package parser
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Node is part of the syntax tree of a bb document.
+type Node interface {
+	Pos() Pos // position of the first byte of the node
+	End() Pos // position of the byte immediately after the node
+}
+
+// Span is the position of a node in the input. It implements the Pos and End methods of Node.
+type Span struct {
+	Start Pos
+	Stop  Pos
+}
+
+func (s Span) Pos() Pos { return s.Start }
+func (s Span) End() Pos { return s.Stop }
+
+func (s Span) empty() bool {
+	return s.Start == s.Stop
+}
+
+// Document is the root of the syntax tree.
+type Document struct {
+	Span
+	Nodes    []Node     // definitions and values, in the order they appear
+	Comments []*Comment // every comment, including comments within definitions
+	input    string
+}
+
+// Definition is a type definition, e.g. ∆ = { type: triangle, +: big }
+type Definition struct {
+	Span
+	Unit  string
+	Props []*Prop
+}
+
+// Prop is a prop of a type definition. Values are kept as written, e.g. a script prop's value is the function.
+type Prop struct {
+	Span
+	Name     string
+	Value    string
+	ValuePos Pos
+}
+
+// UDTInstance is a value of a user or pre-defined type, e.g. 3∆"foo"+
+type UDTInstance struct {
+	Span
+	Quantity  Node // *Number, or *String if it isn't a valid number, or nil if there isn't one
+	Unit      string
+	UnitPos   Pos
+	Value     Node // *Number or *String, or nil if there isn't one
+	Modifiers []*Modifier
+}
+
+// Modifier is a modifier of a UDT instance, e.g. +"foo"
+type Modifier struct {
+	Span
+	Name  string
+	Value Node // *Number or *String, or nil if the modifier doesn't have a value
+}
+
+// String is a bare or quoted string, or a quoted or unquoted UDT value.
+type String struct {
+	Span
+	Value string // without quotes
+	Raw   string // as written
+}
+
+// Number is a number, or the quantity or numerical value of a UDT.
+type Number struct {
+	Span
+	Value float64
+	Raw   string // as written
+}
+
+// Bool is true or false.
+type Bool struct {
+	Span
+	Value bool
+}
+
+// Null is null.
+type Null struct {
+	Span
+}
+
+// Comment is an inline or multiline comment, including import statements.
+type Comment struct {
+	Span
+	Text string // including the comment markers
+}
+
+// Position returns the line and column (in runes) of a position in the document, both starting at 1.
+func (d *Document) Position(p Pos) (line int, column int) {
+	return position(d.input, p)
+}
+
+func position(input string, p Pos) (line int, column int) {
+	return strings.Count(input[:p], "\n") + 1, columnOf(input, p)
+}
+
+// columnOf returns the column of a position, for when the line is already known. It only looks at the line the
+// position is on, so it's cheaper than position in a long input.
+func columnOf(input string, p Pos) int {
+	lineStart := strings.LastIndex(input[:p], "\n") + 1
+	return utf8.RuneCountInString(input[lineStart:p]) + 1
+}
+
+// Inspect traverses the syntax tree in depth-first order, starting with node. If f returns false then the
+// children of the node aren't visited.
+func Inspect(node Node, f func(Node) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+	switch n := node.(type) {
+	case *Document:
+		for _, child := range n.Nodes {
+			Inspect(child, f)
+		}
+		for _, comment := range n.Comments {
+			Inspect(comment, f)
+		}
+	case *Definition:
+		for _, prop := range n.Props {
+			Inspect(prop, f)
+		}
+	case *UDTInstance:
+		Inspect(n.Quantity, f)
+		Inspect(n.Value, f)
+		for _, modifier := range n.Modifiers {
+			Inspect(modifier, f)
+		}
+	case *Modifier:
+		Inspect(n.Value, f)
+	}
+}
+
+// ParseAST returns the syntax tree of the input, and every error found in the input.
+func ParseAST(input string) (*Document, ErrorList) {
+	return NewParser().ParseAST(input)
+}
+
+// ParseAST returns the syntax tree of the input, and every error found in the input.
+func (p *Parser) ParseAST(input string) (*Document, ErrorList) {
+	l := lex(input, p.registry.clone(), p)
+
+	doc := &Document{Span: Span{0, Pos(len(input))}, Nodes: make([]Node, 0), input: input}
+	var errs ErrorList
+	var definition *Definition // the definition we're in, if any
+	var prop *Prop             // the prop we're in, if any
+
+	for item, ok := l.nextItem(); ok; item, ok = l.nextItem() {
+		s := trimmedSpan(item)
+		text := l.input[s.Start:s.Stop]
+
+		switch item.typ {
+		case itemError:
+			errs = append(errs, newError(l.input, item))
+		case itemAssignment:
+			if strings.HasSuffix(text, "{") { // e.g. '∆ = {'
+				definition = &Definition{
+					Span:  s,
+					Unit:  strings.TrimSpace(text[:strings.LastIndex(text, "=")]),
+					Props: make([]*Prop, 0),
+				}
+				doc.Nodes = append(doc.Nodes, definition)
+			} else if text == "}" {
+				definition.Stop = s.Stop
+				definition = nil
+			}
+		case itemPropName:
+			prop = &Prop{Span: s, Name: text}
+			definition.Props = append(definition.Props, prop)
+			definition.Stop = s.Stop
+		case itemPropValue:
+			prop.Value = text
+			prop.ValuePos = s.Start
+			prop.Stop = s.Stop
+			definition.Stop = s.Stop
+		case itemComment:
+			doc.Comments = append(doc.Comments, &Comment{Span: s, Text: text})
+		case itemUDT:
+			doc.Nodes = append(doc.Nodes, newUDTInstance(l.input, item))
+		case itemString, itemNumber, itemBool, itemNull:
+			value, _, _ := l.value(item)
+			switch v := value.(type) {
+			case float64:
+				doc.Nodes = append(doc.Nodes, &Number{Span: s, Value: v, Raw: text})
+			case string:
+				doc.Nodes = append(doc.Nodes, &String{Span: s, Value: v, Raw: text})
+			case bool:
+				doc.Nodes = append(doc.Nodes, &Bool{Span: s, Value: v})
+			case nil:
+				doc.Nodes = append(doc.Nodes, &Null{Span: s})
+			}
+		default:
+			// spaces, tabs, and newlines aren't part of the tree
+		}
+	}
+
+	return doc, errs
+}
+
+// trimmedSpan returns the span of an item without surrounding whitespace, which some items include.
+func trimmedSpan(item item) Span {
+	start := item.pos + Pos(len(item.val)-len(strings.TrimLeft(item.val, " \t\r\n")))
+	end := item.pos + Pos(len(strings.TrimRight(item.val, " \t\r\n")))
+	if end < start {
+		end = start
+	}
+	return Span{start, end}
+}
+
+// newUDTInstance creates a UDTInstance node from the parts of a UDT found by the lexer.
+func newUDTInstance(input string, item item) *UDTInstance {
+	parts := item.udt
+	instance := &UDTInstance{
+		Span:      Span{item.pos, item.pos + Pos(len(item.val))},
+		Quantity:  valueNode(input, parts.quantity),
+		Unit:      input[parts.unit.Start:parts.unit.Stop],
+		UnitPos:   parts.unit.Start,
+		Value:     valueNode(input, parts.value),
+		Modifiers: make([]*Modifier, 0, len(parts.modifiers)),
+	}
+	for _, m := range parts.modifiers {
+		instance.Modifiers = append(instance.Modifiers, &Modifier{
+			Span:  Span{m.name.Start, m.value.Stop},
+			Name:  input[m.name.Start:m.name.Stop],
+			Value: valueNode(input, m.value),
+		})
+	}
+	return instance
+}
+
+// valueNode converts a quantity or value to a node. Quoted values and unquoted values starting with ':' are
+// strings, and anything else is a number, or a string if it isn't a valid number, e.g. 1.0.0
+func valueNode(input string, n Span) Node {
+	if n.empty() {
+		return nil
+	}
+	raw := input[n.Start:n.Stop]
+	switch r := rune(raw[0]); {
+	case isQuoteChar(r) && len(raw) > 1:
+		return &String{Span: n, Value: raw[1 : len(raw)-1], Raw: raw}
+	case r == ':':
+		return &String{Span: n, Value: raw[1:], Raw: raw}
+	}
+	if number, err := strconv.ParseFloat(raw, 64); err == nil {
+		return &Number{Span: n, Value: number, Raw: raw}
+	}
+	return &String{Span: n, Value: raw, Raw: raw}
+}
+
+// rawValue returns a value node as it was written, or "" if there isn't one.
+func rawValue(n Node) string {
+	switch v := n.(type) {
+	case *String:
+		return v.Raw
+	case *Number:
+		return v.Raw
+	}
+	return ""
+}
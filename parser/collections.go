@@ -0,0 +1,144 @@
+package parser
+
+import (
+	"strings"
+	"sync"
+)
+
+// Collection is a set of type definitions that can be imported with '// import <name>', keyed by unit. The props
+// are written as they would be in a definition, e.g. {"kg": {"unit": "kilogram", "type": "weight"}}, so numbers
+// are numerical props and functions are script props.
+type Collection map[string]map[string]string
+
+var (
+	collectionsMu sync.RWMutex
+	collections   = map[string][]*udt{
+		"si":       newCollectionTypes("si", siCollection()),
+		"currency": newCollectionTypes("currency", currencyCollection()),
+		"money":    newCollectionTypes("money", currencyCollection()),
+	}
+)
+
+// RegisterCollection makes a collection available to import by name, e.g. so that '// import lab' imports the
+// types of lab equipment. Names aren't case sensitive. It replaces any collection already registered with the name.
+func RegisterCollection(name string, c Collection) {
+	name = strings.ToLower(name)
+	types := newCollectionTypes(name, c)
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+	collections[name] = types
+}
+
+// newCollectionTypes defines the types in a collection, so that they're only defined once rather than every time
+// the collection is imported.
+func newCollectionTypes(name string, c Collection) []*udt {
+	types := make([]*udt, 0, len(c))
+	for unit, props := range c {
+		t := NewUDTFromDefinition(unit, props)
+		t.origin = "collection " + name
+		types = append(types, t)
+	}
+	return types
+}
+
+// defineImportedTypes adds copies of the types in a collection. ok is false if there isn't a collection with that
+// name.
+func (r *registry) defineImportedTypes(collectionName string) (ok bool) {
+	collectionsMu.RLock()
+	types, ok := collections[strings.ToLower(collectionName)]
+	collectionsMu.RUnlock()
+
+	for _, t := range types {
+		r.addPDT(t.clone())
+	}
+	return ok
+}
+
+func siCollection() Collection {
+	SITypes := []string{
+		"g,gram,weight",
+		"kg,kilogram,weight",
+		"s,second,time",
+		"min,minute,time",
+		"h,hour,time",
+		"d,day,time",
+		"m,metre,length",
+		"km,kilometre,length",
+		"au,astronomical unit,length",
+		"l,litre,volume",
+		"K,kelvin,temperature",
+		"A,ampere,electric current",
+		"mol,mole,amount of substance",
+		"cd,candela,luminous intensity",
+		"rad,radian,plane angle",
+		"sr,steradian,solid angle",
+		"Hz,hertz,frequency",
+		"N,newton,force",
+		"Pa,pascal,pressure",
+		"J,joule,energy",
+		"eV,electron volt,energy",
+		"W,watt,power",
+		"C,coulomb,electric charge",
+		"V,volt,voltage",
+		"F,farad,capacitance",
+		"Ω,ohm,resistance",
+		"S,siemens,electrical conductance",
+		"Wb,weber,magnetic flux",
+		"T,tesla,magnetic flux density",
+		"H,henry,inductance",
+		"°C,Celsius,temperature",
+		"lm,lumen,luminous flux",
+		"lx,lux,illuminance",
+		"Bq,becquerel,radioactivity",
+		"Gy,gray,absorbed dose",
+		"Sv,sievert,equivalent dose",
+		"kat,katal,catalytic activity",
+	}
+
+	c := Collection{}
+	for _, t := range SITypes {
+		def := strings.SplitN(t, ",", 3)
+		c[def[0]] = map[string]string{"unit": def[1], "type": def[2]}
+	}
+	return c
+}
+
+//Quantity	Name	Symbol	Value in SI units
+//plane and
+//phase angle	degree	°	1° = (π/180) rad
+//minute	′	1′ = (1/60)° = (π/10800) rad
+//second	″	1″ = (1/60)′ = (π/648000) rad
+//area	hectare	ha	1 ha = 1 hm2 = 104 m2
+//mass	tonne (metric ton)	t	1 t = 1 000 kg
+//dalton	Da	1 Da = 1.660539040(20)×10−27 kg
+//bel	B
+//decibel	dB
+
+func currencyCollection() Collection {
+	currencyTypes := []string{
+		"$,USD,United States dollar",
+		"£,GBP,British pound",
+		"€,EUR,Euro",
+		"¥,JPY,Japanese yen",
+		"円,Japanese yen",
+		"元,Chinese renminbi yuan",
+		"₹,Indian rupee",
+		"₽,RUB,Russian ruble",
+		"฿,Thai baht",
+
+		// crypto
+		"₿,BTC,Bitcoin",
+		"ETH,Ether",
+		"Ł,LTE,Litecoin",
+		"₳,ADA,Ada",
+	}
+
+	c := Collection{}
+	for _, t := range currencyTypes {
+		def := strings.Split(t, ",")
+		for _, unit := range def[:len(def)-1] {
+			c[unit] = map[string]string{"unit": def[len(def)-1], "type": "money"}
+		}
+	}
+	return c
+}
@@ -0,0 +1,239 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Decoder reads bb from an input stream and returns each value once the line it ends on has been read.
+// Only the statement being decoded is held in memory, so memory use doesn't grow with the size of the input.
+// Statements longer than 1MB, e.g. a raw string that isn't closed, are reported as errors and skipped.
+//
+// Types defined in the stream are available to the rest of the stream, as they would be with Parse. Transforms
+// aren't run, because they need the whole output.
+type Decoder struct {
+	r        *bufio.Reader
+	registry *registry
+	table    bool      // each row is a value in table mode
+	strict   bool      // report values that couldn't be converted
+	pending  []decoded // values and errors that have been decoded but not returned yet
+	line     int       // line number of the next line to be read
+	offset   int       // byte offset of the next line to be read
+	err      error     // error from the reader - io.EOF once the stream has been read
+	parser   *Parser
+	scripts  *runner   // runs the scripts in the stream, which is one document
+	skipping *boundary // the rest of a statement that was too long, which is skipped - see decodeStatement
+}
+
+// decoded is a value or an error found in the stream.
+type decoded struct {
+	value interface{}
+	err   *Error
+}
+
+// NewDecoder returns a Decoder that reads from r and only knows the pre-defined types.
+func NewDecoder(r io.Reader) *Decoder {
+	return NewParser().NewDecoder(r)
+}
+
+// NewDecoder returns a Decoder that reads from r, using the types defined in the parser.
+func (p *Parser) NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), registry: p.registry.clone(), table: p.Table, strict: p.Strict, line: 1, parser: p,
+		scripts: p.newRunner()}
+}
+
+// More reports whether there is another value or error in the stream.
+func (d *Decoder) More() bool {
+	for len(d.pending) == 0 && d.err == nil {
+		d.decodeStatement()
+	}
+	return len(d.pending) > 0
+}
+
+// Next returns the next value in the stream. If the input is invalid then the error is an *Error and
+// decoding can continue with the next call. Once the stream has been read the error is io.EOF, or the
+// error returned by the reader.
+func (d *Decoder) Next() (interface{}, error) {
+	if !d.More() {
+		return nil, d.err
+	}
+	next := d.pending[0]
+	d.pending = d.pending[1:]
+	if next.err != nil {
+		return nil, next.err
+	}
+	return next.value, nil
+}
+
+// maxStatementSize is the most of the stream that is held in memory for one statement, so that an unterminated
+// definition, comment, or string doesn't hold the rest of the stream in memory.
+var maxStatementSize = 1 << 20
+
+// decodeStatement reads lines until it reaches the end of a statement, i.e. a line that doesn't end part way
+// through a definition, comment, or raw string, then decodes them. A statement longer than maxStatementSize is
+// reported as an error as soon as it's found, and the rest of it is skipped by the next call.
+func (d *Decoder) decodeStatement() {
+	if s := d.skipping; s != nil {
+		d.skipping = nil
+		if !s.complete() {
+			size, lines, _ := d.read(s, nil)
+			d.line += lines
+			d.offset += size
+		}
+		return
+	}
+
+	var statement strings.Builder
+	var s boundary
+	size, lines, ok := d.read(&s, &statement)
+	if !ok {
+		text := statement.String()
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			text = text[:i]
+		}
+		d.report(&Error{Line: d.line, Column: 1, Text: text,
+			Message: fmt.Sprintf("statement is longer than %d bytes", maxStatementSize)})
+		d.line += lines
+		d.offset += size
+		d.skipping = &s
+		return
+	}
+	if size == 0 {
+		return
+	}
+
+	l := lexFromLine(statement.String(), d.registry, d.line, d.parser)
+	l.offset = d.offset
+	l.scripts = d.scripts
+	rows := newTable()
+	for item, ok := l.nextItem(); ok; item, ok = l.nextItem() {
+		if item.typ == itemError {
+			d.report(newError(l.input, item))
+		} else if d.table {
+			d.valueErrors(l, item, rows.add(l, item))
+		} else if value, ok, errs := l.value(item); ok {
+			d.valueErrors(l, item, errs)
+			d.pending = append(d.pending, decoded{value: value})
+		}
+	}
+
+	// statements always end at the end of a line, so there won't be a partial row
+	for _, row := range rows.finish() {
+		d.pending = append(d.pending, decoded{value: row})
+	}
+
+	d.line += lines
+	d.offset += size
+}
+
+// report adds an error found in the statement being decoded.
+func (d *Decoder) report(e *Error) {
+	e.Offset += d.offset // offsets are from the start of the stream rather than the statement
+	d.pending = append(d.pending, decoded{err: e})
+}
+
+// valueErrors reports the errors from converting an item in strict mode. Otherwise they're ignored.
+func (d *Decoder) valueErrors(l *lexer, item item, errs []error) {
+	if d.strict {
+		for _, err := range errs {
+			d.report(newValueError(l.input, item, err))
+		}
+	}
+}
+
+// read reads the rest of a statement, adding it to statement unless that's nil. It reads at most the size of the
+// reader's buffer at a time, and stops once the statement is longer than maxStatementSize, in which case ok is
+// false. s keeps track of where the statement ends.
+func (d *Decoder) read(s *boundary, statement *strings.Builder) (size int, lines int, ok bool) {
+	for d.err == nil && (size == 0 || !s.complete()) {
+		chunk, err := d.r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			d.err = err
+		}
+		s.scan(chunk)
+		size += len(chunk)
+		lines += bytes.Count(chunk, []byte("\n"))
+		if statement != nil {
+			if statement.Len()+len(chunk) > maxStatementSize {
+				return size, lines, false
+			}
+			statement.Write(chunk)
+		}
+	}
+	return size, lines, true
+}
+
+// boundary keeps track of whether the lines scanned so far end part way through something that can span
+// multiple lines. It doesn't need to be exact - if it's wrong then more lines than necessary are decoded at once.
+// Only raw strings (in backticks) span lines, so that a stray '"' doesn't hold back the values after it.
+// Lines can be scanned in several chunks.
+type boundary struct {
+	depth       int  // nesting depth of { } in definitions
+	quote       byte // the quote character of the string we're in, if any - only '`' continues onto the next line
+	comment     bool // in a multiline comment
+	lineComment bool // in a '//' comment, which ends at the end of the line
+	escaped     bool // the next byte is escaped by a backslash
+	slash       bool // the last byte was a '/' that could start a '//' comment
+	midLine     bool // the last chunk scanned didn't end with a newline
+	last        byte // the last byte scanned on this line, or 0 at the start of a line
+	previous    byte // the last byte scanned on this line that wasn't a space, or 0 at the start of a line
+}
+
+// complete reports whether the lines scanned so far can be decoded without the lines that follow them.
+func (b *boundary) complete() bool {
+	return b.depth == 0 && b.quote == 0 && !b.comment && !b.midLine
+}
+
+func (b *boundary) scan(chunk []byte) {
+	for _, c := range chunk { // multi-byte runes are never special, so bytes will do
+		if c == '\n' {
+			if b.quote != '`' {
+				b.quote = 0
+			}
+			b.lineComment, b.escaped, b.slash, b.last, b.previous = false, false, false, 0, 0
+			continue
+		}
+		if b.escaped {
+			b.escaped = false
+			continue
+		}
+
+		switch {
+		case b.lineComment:
+		case b.comment:
+			if c == '/' && b.last == '*' {
+				b.comment = false
+				c = ' ' // so that the '/' can't start another comment
+			}
+		case b.quote != 0:
+			if c == '\\' {
+				b.escaped = true
+			} else if c == b.quote {
+				b.quote = 0
+			}
+		case c == '*' && b.last == '/':
+			b.comment = true
+			c = ' ' // so that the '*' can't end the comment
+		case c == '/' && b.last == '/' && b.slash:
+			b.lineComment = true
+		case c == '"' || c == '`' || (c == '\'' && b.depth > 0):
+			b.quote = c
+		case c == '\\' && b.depth > 0:
+			b.escaped = true // escaped '}' or ','
+		case c == '{' && (b.previous == '=' || b.depth > 0):
+			b.depth++
+		case c == '}' && b.depth > 0:
+			b.depth--
+		}
+
+		b.slash = c == '/' && (b.last == 0 || isSpace(rune(b.last)) || b.depth > 0)
+		if !isSpace(rune(c)) {
+			b.previous = c
+		}
+		b.last = c
+	}
+	b.midLine = len(chunk) > 0 && chunk[len(chunk)-1] != '\n'
+}
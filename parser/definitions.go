@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefineJSON adds the types in a JSON object that maps each unit to its props, e.g.
+// {"∆": {"type": "triangle", "sides": 3, "area": "d => d.value / 2"}}. Numbers are numerical props, strings that
+// are functions are script props, and other strings are string props. If any of the types are invalid then none
+// of them are added.
+func (p *Parser) DefineJSON(data []byte) error {
+	var defs map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return fmt.Errorf("invalid definitions: %s", err)
+	}
+	return p.defineData(defs, p.definitionsName("JSON definitions"))
+}
+
+// DefineYAML adds the types in a YAML document that maps each unit to its props - see DefineJSON.
+func (p *Parser) DefineYAML(data []byte) error {
+	var defs map[string]map[string]interface{}
+	if err := yaml.Unmarshal(data, &defs); err != nil {
+		return fmt.Errorf("invalid definitions: %s", err)
+	}
+	return p.defineData(defs, p.definitionsName("YAML definitions"))
+}
+
+// defineData adds the types in decoded definitions. origin says where they came from, for Types.
+func (p *Parser) defineData(defs map[string]map[string]interface{}, origin string) error {
+	units := make([]string, 0, len(defs))
+	for unit := range defs {
+		units = append(units, unit)
+	}
+	sort.Strings(units) // so that the same error is reported every time
+
+	types := make([]*udt, 0, len(units))
+	for _, unit := range units {
+		t, err := newUDTFromData(unit, defs[unit], p.Logger)
+		if err != nil {
+			return err
+		}
+		t.origin = origin
+		types = append(types, t)
+	}
+
+	for _, t := range types {
+		p.registry.defineUDT(t)
+	}
+	p.registry.units() // build the unit tries now, like Define
+	return nil
+}
+
+// newUDTFromData creates a UDT from props that have been decoded from JSON or YAML, like NewUDTFromDefinition
+// does from props that have been lexed.
+func newUDTFromData(unit string, props map[string]interface{}, logger Logger) (*udt, error) {
+	log(logger, "Define new UDT with unit "+unit)
+	if strings.TrimSpace(unit) == "" {
+		return nil, errors.New("invalid definitions: unit cannot be empty")
+	}
+
+	numericalProps := map[string]float64{}
+	stringProps := map[string]string{}
+	scriptProps := map[string]string{}
+	quoteModifiers := false
+
+	for propName, propValue := range props {
+		if propName == "" {
+			return nil, fmt.Errorf("invalid definition of '%s': prop name cannot be empty", unit)
+		}
+		if strings.Contains(propName, "\"") {
+			quoteModifiers = true
+		}
+
+		switch v := propValue.(type) {
+		case float64:
+			numericalProps[propName] = v
+		case int:
+			numericalProps[propName] = float64(v)
+		case bool:
+			stringProps[propName] = strconv.FormatBool(v)
+		case string:
+			if isFunction(v) {
+				log(logger, "script prop: "+propName+", with value: "+v)
+				scriptProps[propName] = v
+			} else {
+				stringProps[propName] = v
+			}
+		default:
+			return nil, fmt.Errorf("invalid definition of '%s': prop '%s' must be a number or a string", unit, propName)
+		}
+	}
+
+	return NewUDT(unit, numericalProps, stringProps, scriptProps, quoteModifiers), nil
+}
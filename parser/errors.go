@@ -0,0 +1,91 @@
+package parser
+
+import "fmt"
+
+// Error describes a problem found in the input, e.g. an unclosed comment or an unterminated string.
+type Error struct {
+	Line    int    // line number, starting at 1
+	Column  int    // column number in runes, starting at 1
+	Offset  int    // byte offset from the start of the input
+	Text    string // the offending text
+	Message string // description of the problem
+	Err     error  // the underlying error if the problem was found when converting a value, e.g. a *ScriptError
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorList is a list of errors in the order they were found in the input.
+type ErrorList []*Error
+
+func (e ErrorList) Error() string {
+	switch len(e) {
+	case 0:
+		return "no errors"
+	case 1:
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", e[0], len(e)-1)
+}
+
+// ScriptError is a script prop or transform that couldn't be run, or whose result couldn't be converted. These are
+// only reported in strict mode - otherwise the value of the prop is null, and a transform leaves the output as it was.
+type ScriptError struct {
+	Unit    string // the unit of the type the prop is defined in, or "" for a transform
+	Prop    string // the name of the prop
+	Message string // the JavaScript exception, e.g. "ReferenceError: 'x' is not defined"
+}
+
+func (e *ScriptError) Error() string {
+	if e.Unit == "" {
+		return fmt.Sprintf("%s failed: %s", e.Prop, e.Message)
+	}
+	return fmt.Sprintf("script prop '%s' of '%s' failed: %s", e.Prop, e.Unit, e.Message)
+}
+
+// DecodeError is the value of a pre-defined type like json or toml whose value couldn't be decoded. It's reported
+// as an error in strict mode too.
+type DecodeError struct {
+	Type    string `json:"type"`  // always "error", so the value can be told apart in the output
+	Unit    string `json:"unit"`  // the unit of the type, e.g. "toml"
+	Value   string `json:"value"` // the value that couldn't be decoded
+	Message string `json:"error"` // why it couldn't be decoded
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("couldn't decode %s value: %s", e.Unit, e.Message)
+}
+
+// newError converts an error item into an Error, working out the column from the input.
+func newError(input string, i item) *Error {
+	_, column := position(input, i.pos)
+	message := i.message
+	if message == "" {
+		message = "invalid syntax"
+	}
+	return &Error{
+		Line:    i.line,
+		Column:  column,
+		Offset:  int(i.pos),
+		Text:    i.val,
+		Message: message,
+	}
+}
+
+// newValueError creates an Error for an item that couldn't be converted to its value.
+func newValueError(input string, i item, err error) *Error {
+	_, column := position(input, i.pos)
+	return &Error{
+		Line:    i.line,
+		Column:  column,
+		Offset:  int(i.pos),
+		Text:    i.val,
+		Message: err.Error(),
+		Err:     err,
+	}
+}
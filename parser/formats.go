@@ -0,0 +1,163 @@
+package parser
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io"
+	"strings"
+)
+
+// The decoders for the built-in pre-defined types - see RegisterDecoder.
+
+func decodeJSON(value string) (interface{}, error) {
+	var data interface{}
+	err := json.Unmarshal([]byte(value), &data)
+	return data, err
+}
+
+func decodeYAML(value string) (interface{}, error) {
+	var data interface{}
+	if err := yaml.Unmarshal([]byte(value), &data); err != nil {
+		return nil, err
+	}
+	return convert(data), nil
+}
+
+func decodeTOML(value string) (interface{}, error) {
+	data := map[string]interface{}{}
+	_, err := toml.Decode(value, &data)
+	return data, err
+}
+
+// decodeCSV converts a CSV table to an array of objects, using the first row as the keys. Values are kept as
+// strings, because CSV doesn't say what type they are.
+func decodeCSV(value string) (interface{}, error) {
+	r := csv.NewReader(strings.NewReader(strings.TrimSpace(value)))
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]interface{}, 0)
+	if len(records) == 0 {
+		return rows, nil
+	}
+	header := records[0]
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(header))
+		for i, key := range header {
+			row[key] = record[i] // the reader checks that every row has the same number of fields
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// decodeXML converts an XML document to an object with the root element as its only key. Elements that only
+// contain text are strings. Other elements are objects, with attributes as '@name', text as '#text', and child
+// elements by name - arrays if there are several with the same name.
+func decodeXML(value string) (interface{}, error) {
+	d := xml.NewDecoder(strings.NewReader(value))
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return nil, errors.New("no root element")
+		} else if err != nil {
+			return nil, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			element, err := decodeXMLElement(d, start)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{start.Name.Local: element}, nil
+		}
+	}
+}
+
+func decodeXMLElement(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	data := map[string]interface{}{}
+	for _, attr := range start.Attr {
+		data["@"+attr.Name.Local] = attr.Value
+	}
+
+	var text strings.Builder
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			child, err := decodeXMLElement(d, t)
+			if err != nil {
+				return nil, err
+			}
+			name := t.Name.Local
+			switch existing := data[name].(type) {
+			case nil:
+				data[name] = child
+			case []interface{}:
+				data[name] = append(existing, child)
+			default:
+				data[name] = []interface{}{existing, child}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			s := strings.TrimSpace(text.String())
+			if len(data) == 0 {
+				return s, nil
+			}
+			if s != "" {
+				data["#text"] = s
+			}
+			return data, nil
+		}
+	}
+}
+
+// decodeINI converts an INI file to an object. Keys before the first section are at the top level, and each
+// section is an object. Values are kept as strings, without quotes. Lines starting with ';' or '#' are comments.
+func decodeINI(value string) (interface{}, error) {
+	data := map[string]interface{}{}
+	section := data
+
+	scanner := bufio.NewScanner(strings.NewReader(value))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case text == "" || text[0] == ';' || text[0] == '#':
+			continue
+		case text[0] == '[':
+			if text[len(text)-1] != ']' {
+				return nil, fmt.Errorf("line %d: expected ']' at the end of the section name", line)
+			}
+			name := strings.TrimSpace(text[1 : len(text)-1])
+			if existing, ok := data[name].(map[string]interface{}); ok {
+				section = existing
+			} else {
+				section = map[string]interface{}{}
+				data[name] = section
+			}
+		default:
+			i := strings.IndexAny(text, "=:")
+			if i < 0 {
+				return nil, fmt.Errorf("line %d: expected 'key = value'", line)
+			}
+			v := strings.TrimSpace(text[i+1:])
+			if len(v) > 1 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+				v = v[1 : len(v)-1]
+			}
+			section[strings.TrimSpace(text[:i])] = v
+		}
+	}
+	return data, scanner.Err()
+}
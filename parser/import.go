@@ -0,0 +1,188 @@
+package parser
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// importSpec is what an import comment asks for, e.g. '// import si as si. only kg,m,s'.
+type importSpec struct {
+	name   string          // the collection or file to import
+	prefix string          // added to the start of each unit, with 'as'
+	only   map[string]bool // if not nil, the only units that are imported, with 'only'
+	except map[string]bool // units that aren't imported, with 'except'
+}
+
+// parseImport splits an import into the name of the collection or file and its options, which can be in any order.
+// The units after 'only' and 'except' are separated by commas, e.g. 'si only kg, m, s'.
+func parseImport(s string) (spec importSpec, err error) {
+	words := strings.Fields(s)
+	spec.name = words[0]
+	for i := 1; i < len(words); i++ {
+		switch keyword := words[i]; keyword {
+		case "as":
+			if i+1 == len(words) {
+				return spec, fmt.Errorf("expected a prefix after 'as'")
+			}
+			i++
+			spec.prefix = words[i]
+		case "only", "except":
+			units := map[string]bool{}
+			for ; i+1 < len(words) && words[i+1] != "as" && words[i+1] != "only" && words[i+1] != "except"; i++ {
+				for _, unit := range strings.Split(words[i+1], ",") {
+					if unit != "" {
+						units[unit] = true
+					}
+				}
+			}
+			if len(units) == 0 {
+				return spec, fmt.Errorf("expected units after '%s'", keyword)
+			}
+			if keyword == "only" {
+				spec.only = units
+			} else {
+				spec.except = units
+			}
+		default:
+			return spec, fmt.Errorf("unexpected '%s' in import, expected 'as', 'only' or 'except'", keyword)
+		}
+	}
+	return spec, nil
+}
+
+// includes returns true if a unit from the collection should be imported.
+func (spec importSpec) includes(unit string) bool {
+	return (spec.only == nil || spec.only[unit]) && !spec.except[unit]
+}
+
+// importTypes adds the types from a collection, e.g. '// import si', or from a bb file, e.g.
+// '// import ./types/inventory.bb'. Paths are files if they end in '.bb' or start with '.' or '/'.
+// The units of a collection can be prefixed, e.g. '// import si as si.', and filtered, e.g.
+// '// import si only kg,m,s' or '// import si except d,h'.
+func (l *lexer) importTypes(s string) error {
+	spec, err := parseImport(s)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(spec.name, ".bb") || strings.HasPrefix(spec.name, ".") || filepath.IsAbs(spec.name) {
+		if spec.prefix != "" || spec.only != nil || spec.except != nil {
+			return fmt.Errorf("'as', 'only' and 'except' can only be used with collections")
+		}
+		return l.importFile(spec.name)
+	}
+
+	collection := &registry{UDTs: map[string]*udt{}, PDTs: map[string]*udt{}}
+	if !collection.defineImportedTypes(spec.name) {
+		return fmt.Errorf("unknown collection '%s'", spec.name)
+	}
+	for _, units := range []map[string]bool{spec.only, spec.except} {
+		for unit := range units {
+			if collection.PDTs[unit] == nil {
+				return fmt.Errorf("'%s' isn't in %s", unit, spec.name)
+			}
+		}
+	}
+
+	for unit, t := range collection.PDTs {
+		if spec.includes(unit) {
+			t.Unit = spec.prefix + unit
+			l.addPDT(t)
+		}
+	}
+	return nil
+}
+
+// importFile adds the definitions, imports and transforms in a bb file, relative to the directory of the file
+// being lexed. Each file is only imported once, and anything else in it is ignored.
+func (l *lexer) importFile(name string) error {
+	if l.parser.NoFileImports {
+		return fmt.Errorf("couldn't import '%s': importing files is disabled", name)
+	}
+
+	file := name // the name of the file for the origins of its types, relative to the working directory if dir is
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(l.dir, file)
+	}
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return fmt.Errorf("couldn't import '%s': %s", name, err)
+	}
+	if l.parser.RestrictImports && !l.parser.inDir(path) {
+		return fmt.Errorf("couldn't import '%s': it isn't in the import directory", name)
+	}
+
+	for i, importing := range l.importing {
+		if importing == path {
+			return fmt.Errorf("import cycle: %s", strings.Join(append(l.importing[i:], path), " -> "))
+		}
+	}
+	if l.imported[path] {
+		return nil
+	}
+
+	input, err := l.parser.readFile(path)
+	if err != nil {
+		return fmt.Errorf("couldn't import '%s': %s", name, err)
+	}
+
+	l.importing = append(l.importing, path)
+	defer func() {
+		l.importing = l.importing[:len(l.importing)-1]
+	}()
+
+	imported := lex(input, l.registry, l.parser)
+	imported.dir = filepath.Dir(file)
+	imported.name = file
+	var first *Error
+	for item, ok := imported.nextItem(); ok; item, ok = imported.nextItem() {
+		if item.typ == itemError && first == nil {
+			first = newError(imported.input, item)
+		}
+	}
+	if first != nil {
+		return fmt.Errorf("error in '%s': %s", name, first)
+	}
+
+	l.own()
+	l.imported[path] = true
+	return nil
+}
+
+// inDir reports whether a file is in the parser's Dir or its subdirectories, after following symlinks.
+func (p *Parser) inDir(path string) bool {
+	dir, err := filepath.Abs(p.Dir)
+	if err != nil {
+		return false
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return false
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// readFile returns the contents of a file, which are cached so that files imported by every input are only read
+// once. Create a new Parser to see changes to imported files.
+func (p *Parser) readFile(path string) (string, error) {
+	p.filesMu.Lock()
+	defer p.filesMu.Unlock()
+
+	if input, ok := p.files[path]; ok {
+		return input, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if p.files == nil {
+		p.files = map[string]string{}
+	}
+	p.files[path] = string(data)
+	return string(data), nil
+}
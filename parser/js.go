@@ -1,48 +1,222 @@
 package parser
 
 import (
-	"github.com/robertkrimen/otto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dop251/goja"
+	"github.com/dop251/goja/ast"
+	jsparser "github.com/dop251/goja/parser"
 	"math"
+	"reflect"
+	"time"
+	"unicode"
 )
 
-// script is a definition of a function called f, that takes datum as an argument
-func RunScript(script string, datum interface{}) interface{} {
-	vm := otto.New()
-	_, err := vm.Run(script) // define function
+// errScriptTimeout is used to stop a script that has run for too long.
+var errScriptTimeout = errors.New("script timeout")
+
+// script is a compiled script prop, so it can be run in any VM without compiling it again.
+type script struct {
+	program *goja.Program
+	err     error // the syntax error if the script couldn't be compiled
+}
+
+// compileScript compiles a script prop, i.e. a function. Running the program returns the function.
+func compileScript(source string) *script {
+	program, err := goja.Compile("", "("+source+"\n)", false)
+	return &script{program: program, err: err}
+}
+
+// isFunction returns true if a prop value is a JavaScript function, e.g. 'd => d.value * 2' or
+// 'function(d) { return d.value * 2 }'. Values that start like a function but aren't valid JavaScript are treated
+// as functions too, so that the syntax error is reported when they're run.
+func isFunction(value string) bool {
+	program, err := jsparser.ParseFile(nil, "", "("+value+"\n)", 0)
 	if err != nil {
-		log("Got an error defining function '" + script + "'")
-		panic(err)
+		return looksLikeFunction(value)
+	}
+	if len(program.Body) != 1 {
+		return false
 	}
+	if statement, ok := program.Body[0].(*ast.ExpressionStatement); ok {
+		switch statement.Expression.(type) {
+		case *ast.ArrowFunctionLiteral, *ast.FunctionLiteral:
+			return true
+		}
+	}
+	return false
+}
 
-	err = vm.Set("d", datum) // define input to function
-	if err != nil {
-		// TODO: fail in strict mode
-		//panic(err)
-		log("Couldn't set d")
-		return nil
+// RunScript runs a script that defines a function called f, e.g. 'function f(d) { return d * 2 }', with datum as
+// its argument, and returns the result, or nil if it failed. A function on its own, like a script prop, works too.
+// Use RunScriptWithErrors to find out why a script failed.
+func RunScript(source string, datum interface{}) interface{} {
+	s := compileScript(source)
+	if !isFunction(source) {
+		program, err := goja.Compile("", source+"\n;f", false) // the result of the program is f
+		s = &script{program: program, err: err}
 	}
+	value, _ := (&Parser{}).newRunner().run(s, datum)
+	return value
+}
+
+// RunScriptWithErrors runs a script prop, i.e. a function, with datum as its argument, without any limits.
+// The error is the JavaScript exception if the script couldn't be run, and the result is nil.
+func RunScriptWithErrors(source string, datum interface{}, logger Logger) (interface{}, error) {
+	return (&Parser{Logger: logger}).newRunner().run(compileScript(source), datum)
+}
+
+// RegisterFunc makes a Go function available to every script prop as a global with the given name, e.g. a lookup
+// in a product catalogue that definitions can call as 'price: d => lookup(d.value)'. Arguments and results are
+// converted between JavaScript and Go values, and if the last result is a non-nil error then it's thrown as an
+// exception. The name can't be 'bb', which is the object with the built-in helpers. Like Define, it can't be called
+// at the same time as Parse.
+func (p *Parser) RegisterFunc(name string, fn interface{}) error {
+	if !isIdentifier(name) {
+		return fmt.Errorf("'%s' isn't a valid JavaScript name", name)
+	}
+	if name == "bb" {
+		return errors.New("'bb' is reserved for the built-in helpers")
+	}
+	if fn == nil || reflect.TypeOf(fn).Kind() != reflect.Func {
+		return fmt.Errorf("'%s' isn't a function", name)
+	}
+	if p.funcs == nil {
+		p.funcs = map[string]interface{}{}
+	}
+	p.funcs[name] = fn
+	return nil
+}
+
+// isIdentifier returns true if s can be used as the name of a JavaScript variable.
+func isIdentifier(s string) bool {
+	for i, r := range s {
+		if !(r == '_' || r == '$' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// runner runs the scripts in one document with a parser's limits on how long they can run for and how big their
+// results can be. Each document gets its own VM, so that a script can't change the globals - built-ins, bb, or
+// registered functions - that the scripts in other documents see. Scripts in the same document share the VM.
+type runner struct {
+	p         *Parser
+	vm        *goja.Runtime
+	functions map[*script]goja.Callable // the functions that have been defined in vm
+}
 
-	value, err := vm.Run("f(d)") // run function
+func (p *Parser) newRunner() *runner {
+	return &runner{p: p}
+}
+
+// newVM returns a new VM with the bb helpers and the registered functions.
+func (p *Parser) newVM() *goja.Runtime {
+	vm := goja.New()
+	if _, err := vm.RunProgram(stdlibProgram); err != nil {
+		panic(err) // the helpers don't depend on the input, so this can only be a bug
+	}
+	for name, fn := range p.funcs {
+		_ = vm.Set(name, fn) // names are checked by RegisterFunc
+	}
+	return vm
+}
+
+// run runs a script prop, i.e. a function, with args as its arguments.
+func (r *runner) run(s *script, args ...interface{}) (interface{}, error) {
+	p := r.p
+	if s.err != nil {
+		log(p.Logger, "Got an error compiling the function")
+		return nil, s.err
+	}
+
+	if r.vm == nil {
+		r.vm, r.functions = p.newVM(), map[*script]goja.Callable{}
+	}
+	vm := r.vm
+
+	if p.ScriptTimeout > 0 {
+		timer := time.AfterFunc(p.ScriptTimeout, func() {
+			vm.Interrupt(errScriptTimeout)
+		})
+		defer func() {
+			if !timer.Stop() {
+				r.vm = nil // the interrupt might not have happened yet, so the VM can't be used again
+			}
+		}()
+	}
+
+	function, ok := r.functions[s]
+	if !ok {
+		value, err := vm.RunProgram(s.program) // define function
+		if err != nil {
+			log(p.Logger, "Got an error defining the function")
+			return nil, p.scriptError(err)
+		}
+		if function, ok = goja.AssertFunction(value); !ok {
+			log(p.Logger, "The script isn't a function")
+			return nil, errors.New("script isn't a function")
+		}
+		r.functions[s] = function
+	}
+
+	values := make([]goja.Value, len(args))
+	for i, arg := range args {
+		values[i] = vm.ToValue(arg)
+	}
+	value, err := function(goja.Undefined(), values...) // run function
 	if err != nil {
-		// TODO: fail in strict mode
-		//panic(err)
-		log("Couldn't run the function 'f(d)'")
-		return nil
+		log(p.Logger, "Couldn't run the function")
+		return nil, p.scriptError(err)
 	}
 
-	d, err := value.Export()
+	d := exportValue(value.Export())
 
 	// NaN doesn't convert to JSON, so convert it to nil
 	if floatD, ok := d.(float64); ok && math.IsNaN(floatD) {
-		return nil
+		return nil, nil
 	}
 
-	if err != nil {
-		// TODO: fail in strict mode
-		//panic(err)
-		log("Couldn't export the result")
-		return nil
+	if p.MaxScriptOutput > 0 {
+		j, err := json.Marshal(d)
+		if err != nil {
+			log(p.Logger, "Couldn't convert the result to JSON")
+			return nil, errors.New("couldn't convert the result: " + err.Error())
+		}
+		if len(j) > p.MaxScriptOutput {
+			log(p.Logger, "The result is too big")
+			return nil, fmt.Errorf("result is larger than %d bytes", p.MaxScriptOutput)
+		}
 	}
 
-	return d
+	return d, nil
+}
+
+// scriptError converts an error from the VM to the error reported for the script.
+func (p *Parser) scriptError(err error) error {
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) && interrupted.Value() == errScriptTimeout {
+		log(p.Logger, "The script timed out")
+		return fmt.Errorf("script took longer than %s", p.ScriptTimeout)
+	}
+	return err
+}
+
+// exportValue converts integers exported from the VM to float64, like every other number in bb.
+func exportValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int64:
+		return float64(x)
+	case map[string]interface{}:
+		for k, value := range x {
+			x[k] = exportValue(value)
+		}
+	case []interface{}:
+		for i, value := range x {
+			x[i] = exportValue(value)
+		}
+	}
+	return v
 }
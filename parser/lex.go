@@ -17,11 +17,27 @@ type Pos int
 
 // item represents a token or text string returned from the scanner.
 type item struct {
-	typ     itemType // The type of this item.
-	pos     Pos      // The starting position, in bytes, of this item in the input string.
-	val     string   // The value of this item.
-	line    int      // The line number at the start of this item.
-	message string   // additional info about the item, e.g. an error message
+	typ     itemType  // The type of this item.
+	pos     Pos       // The starting position, in bytes, of this item in the input string.
+	val     string    // The value of this item.
+	line    int       // The line number at the start of this item.
+	message string    // additional info about the item, e.g. an error message
+	udt     *udtParts // the parts of a UDT, for UDT items
+}
+
+// udtParts holds the parts of a UDT instance, found while lexing. Spans are empty if the part is missing.
+type udtParts struct {
+	t         *udt // the type of the instance
+	quantity  Span
+	unit      Span
+	value     Span // includes quotes or ':'
+	modifiers []modifierPart
+}
+
+// modifierPart is a modifier found in a UDT instance. The value is empty if the modifier doesn't have one.
+type modifierPart struct {
+	name  Span
+	value Span
 }
 
 func (i item) String() string {
@@ -73,58 +89,24 @@ type stateFn func(*lexer) stateFn
 
 // lexer holds the state of the scanner.
 type lexer struct {
-	name        string    // the name of the input; used only for error reports
+	name        string    // the name of the input, e.g. its file name; used for the origins of the types it defines
 	input       string    // the string being scanned
 	emitComment bool      // emit itemComment tokens.
 	pos         Pos       // current position in the input
 	start       Pos       // start position of this item
 	width       Pos       // width of last rune read from input
-	items       chan item // channel of scanned items
+	items       []item    // scanned items, from head onwards they haven't been returned by nextItem yet
+	head        int       // index of the next item to return
+	state       stateFn   // the next state function to run, or nil once the input has been scanned
 	parenDepth  int       // nesting depth of ( ) exprs
 	line        int       // 1+number of newlines seen
 	startLine   int       // start line of this item
-	// if dashAllowed is true, then '-' can be used to represent negative numbers in values and quantities (default behavior)
-	// if the user defines it as a type then dashAllowed will be set to false and '-' will only be treated as a udt.
-	// if '-' is used as a modifier at the same time as negative values, strange things will happen
-	dashAllowed bool
-	// if dotAllowed is true, then '.' can be used to represent decimal numbers (default behavior)
-	// if the user defines it as a type then dotAllowed will be set to false and '.' will only be treated as a udt.
-	// if '.' is used as a modifier, strange things will happen
-	dotAllowed bool
-	// if colonAllowed is true, then ':' can be used to start an unquoted value (default behavior)
-	// if the user defines it as a type or modifier then colonAllowed will be set to false and
-	// unquoted values will be disabled
-	colonAllowed      bool
-	UDTs              map[string]*udt       // stores user defined types
-	PDTs              map[string]*udt       // stores pre-defined types - these can change if user imports more types
-	udtInstances      []string              // stores the unit of every UDT we find
-	instanceIndex     int                   // only used for parsing - the current index of udtInstances we're parsing
-	modifierInstances []map[string][]string // stores every modifier and raw values we find TODO: this can be moved to the UDTs
-}
-
-var verbose = false
-
-func SetVerbose() {
-	verbose = true
-}
-
-func log(message string) {
-	if verbose {
-		if len(message) == 1 {
-			if message == "\n" {
-				message = "\\n"
-			}
-			fmt.Print("/\033[94m", message, "\033[0m")
-		} else if message == "lexBb" {
-			fmt.Print("\n\033[92m", message, "\033[0m")
-		} else {
-			if strings.HasPrefix(message, "lex") {
-				fmt.Print("/\033[92m", message, "\033[0m")
-			} else {
-				fmt.Print("/", message)
-			}
-		}
-	}
+	*registry             // the types we know about - definitions and imports in the input are added to it
+	udt         *udtParts // the parts of the UDT currently being scanned
+	parser      *Parser   // settings for logging and converting values
+	offset      int       // byte offset of the input in the stream it was read from, if it isn't the whole stream
+	dir         string    // the directory that relative imports are resolved against
+	scripts     *runner   // runs the scripts in the document
 }
 
 // next returns the next rune in the input.
@@ -139,7 +121,9 @@ func (l *lexer) next() rune {
 	if r == '\n' {
 		l.line++
 	}
-	log(string(r))
+	if l.parser.Logger != nil {
+		l.log(string(r))
+	}
 	return r
 }
 
@@ -161,7 +145,7 @@ func (l *lexer) backup() {
 
 // emit passes an item back to the client.
 func (l *lexer) emit(t itemType) {
-	l.items <- item{t, l.start, l.input[l.start:l.pos], l.startLine, ""}
+	l.items = append(l.items, item{t, l.start, l.input[l.start:l.pos], l.startLine, "", nil})
 	l.start = l.pos
 	l.startLine = l.line
 }
@@ -189,56 +173,71 @@ func (l *lexer) acceptRun(valid string) {
 	l.backup()
 }
 
-// errorf returns an error token and terminates the scan by passing
-// back a nil pointer that will be the next state, terminating l.nextItem.
+// errorf emits an error token and returns lexBb so that scanning carries on with whatever comes next.
+// The caller should first move past the invalid input, e.g. with skipUntil.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- item{itemError, l.start, l.input[l.start:l.pos], l.startLine, fmt.Sprintf(format, args...)}
-	return nil
+	l.emitError(format, args...)
+	return lexBb
 }
 
-// nextItem returns the next item from the input.
-// Called by the parser, not in the lexing goroutine.
-func (l *lexer) nextItem() item {
-	return <-l.items
+// emitError passes an error item back to the client without terminating the scan.
+func (l *lexer) emitError(format string, args ...interface{}) {
+	l.items = append(l.items, item{itemError, l.start, l.input[l.start:l.pos], l.startLine, fmt.Sprintf(format, args...), nil})
+	l.start = l.pos
+	l.startLine = l.line
 }
 
-// drain drains the output so the lexing goroutine will exit.
-// Called by the parser, not in the lexing goroutine.
-func (l *lexer) drain() {
-	for range l.items {
-	}
+// emitUDT passes the UDT we've just scanned back to the client.
+func (l *lexer) emitUDT() {
+	l.items = append(l.items, item{itemUDT, l.start, l.input[l.start:l.pos], l.startLine, "", l.udt})
+	l.udt = nil
+	l.start = l.pos
+	l.startLine = l.line
 }
 
-// lex creates a new top level scanner for the input string.
-func lex(input string) *lexer {
-
-	l := &lexer{
-		name:              "bb",
-		input:             input + "\n",
-		items:             make(chan item),
-		line:              1,
-		startLine:         1,
-		instanceIndex:     0,
-		dashAllowed:       true,
-		dotAllowed:        true,
-		colonAllowed:      true,
-		modifierInstances: []map[string][]string{},
-		UDTs:              map[string]*udt{},
-		PDTs:              map[string]*udt{},
+// skipUntil consumes runes up to, but not including, the next rune from the stop set, or EOF.
+// Used to resynchronise after an error.
+func (l *lexer) skipUntil(stop string) {
+	for r := l.next(); r != eof && !strings.ContainsRune(stop, r); r = l.next() {
 	}
+	l.backup()
+}
 
-	l.defineBuiltInTypes()
+// nextItem returns the next item from the input, running the state machine until it has emitted one.
+// ok is false once every item has been returned.
+func (l *lexer) nextItem() (item item, ok bool) {
+	for l.head == len(l.items) {
+		if l.state == nil {
+			return item, false
+		}
+		l.items, l.head = l.items[:0], 0 // every item has been returned, so reuse the space
+		l.state = l.state(l)
+	}
+	item = l.items[l.head]
+	l.head++
+	return item, true
+}
 
-	go l.run()
-	return l
+// lex creates a new top level scanner for the input string. Types defined in the input are added to r.
+func lex(input string, r *registry, p *Parser) *lexer {
+	return lexFromLine(input, r, 1, p)
 }
 
-// run runs the state machine for the lexer.
-func (l *lexer) run() {
-	for state := lexBb; state != nil; {
-		state = state(l)
+// lexFromLine is like lex for input that starts part way through a document, at the given line number.
+func lexFromLine(input string, r *registry, line int, p *Parser) *lexer {
+
+	l := &lexer{
+		input:     input + "\n",
+		line:      line,
+		startLine: line,
+		registry:  r,
+		state:     lexBb,
+		parser:    p,
+		dir:       p.Dir,
+		scripts:   p.newRunner(),
 	}
-	close(l.items)
+
+	return l
 }
 
 // state functions
@@ -250,7 +249,7 @@ const (
 
 // lexBb scans bb
 func lexBb(l *lexer) stateFn {
-	log("lexBb")
+	l.log("lexBb")
 
 	switch r := l.next(); {
 	case r == eof:
@@ -275,7 +274,8 @@ func lexBb(l *lexer) stateFn {
 		l.backup()
 		return lexIdentifier
 	case r == '/':
-		if l.accept("*") {
+		if l.peek() == '*' {
+			l.backup() // lexComment expects to be at the start of the comment
 			return lexComment
 		} else if l.accept("/") {
 			return lexInlineComment
@@ -290,28 +290,42 @@ func lexBb(l *lexer) stateFn {
 
 // lexComment scans a comment. The left comment marker is known to be present.
 func lexComment(l *lexer) stateFn {
-	log("lexComment")
+	l.log("lexComment")
 	l.pos += Pos(len(leftComment))
 	i := strings.Index(l.input[l.pos:], rightComment)
 	if i < 0 {
+		// the rest of the input is part of the comment
+		l.line += strings.Count(l.input[l.pos:], "\n")
+		l.pos = Pos(len(l.input))
 		return l.errorf("unclosed comment")
 	}
+	l.line += strings.Count(l.input[l.pos:l.pos+Pos(i)], "\n")
 	l.pos += Pos(i + len(rightComment))
 	l.emit(itemComment)
 	return lexBb
 }
 
 func lexInlineComment(l *lexer) stateFn {
-	log("lexInlineComment")
+	l.log("lexInlineComment")
 	i := strings.Index(l.input[l.pos:], "\n") // there will always be one because we add one
 
-	log("comment is: " + l.input[l.pos:l.pos+Pos(i)])
+	if l.parser.Logger != nil {
+		l.log("comment is: " + l.input[l.pos:l.pos+Pos(i)])
+	}
 	cleanedComment := strings.TrimSpace(strings.Replace(l.input[l.pos:l.pos+Pos(i)], "//", "", 1))
 	splitComment := strings.SplitN(cleanedComment, " ", 2)
+	l.pos += Pos(i)
 	if splitComment[0] == "import" && len(splitComment) > 1 {
-		l.defineImportedTypes(strings.ToLower(splitComment[1]))
+		l.log("importing " + splitComment[1])
+		if err := l.importTypes(splitComment[1]); err != nil {
+			return l.errorf("%s", err)
+		}
+	} else if splitComment[0] == "transform" && len(splitComment) > 1 && isFunction(splitComment[1]) {
+		// other comments can start with 'transform' too, e.g. '// transform the list below'
+
+		l.log("adding transform " + splitComment[1])
+		l.defineTransform(splitComment[1])
 	}
-	l.pos += Pos(i)
 	l.emit(itemComment)
 	return lexBb
 }
@@ -319,7 +333,7 @@ func lexInlineComment(l *lexer) stateFn {
 // lexSpace scans a run of space characters.
 // We have not consumed the first space, which is known to be present.
 func lexSpace(l *lexer) stateFn {
-	log("lexSpace")
+	l.log("lexSpace")
 	var r rune
 	var numSpaces int
 	for {
@@ -331,7 +345,7 @@ func lexSpace(l *lexer) stateFn {
 		if r == ' ' {
 			numSpaces++
 		} else if r == '\n' {
-			log("found newline")
+			l.log("found newline")
 			l.acceptRun(" ") // ignore whitespace at start of next line
 			l.emit(itemNewline)
 			return lexBb
@@ -350,7 +364,7 @@ func lexSpace(l *lexer) stateFn {
 
 // scans an alphanumeric that isn't a udt or a number (could be a definition or bool or string)
 func lexIdentifier(l *lexer) stateFn {
-	log("lexIdentifier")
+	l.log("lexIdentifier")
 Loop:
 	for {
 		switch r := l.next(); {
@@ -366,13 +380,17 @@ Loop:
 			case word == "null":
 				l.emit(itemNull)
 			default:
-				log("word is " + word)
+				if l.parser.Logger != nil {
+					l.log("word is " + word)
+				}
 
 				// look-ahead for assignment
-				l.acceptRun(" ") // todo: don't consume tabs here if there isn't an assignment
+				wordEnd := l.pos
+				l.acceptRun(" ")
 				if l.accept("=") {
 					return lexDefinition
 				}
+				l.pos = wordEnd // don't consume the spaces - they could be a tab
 				l.emit(itemString)
 			}
 			break Loop
@@ -384,7 +402,7 @@ Loop:
 
 // scans an alphanumeric that isn't a udt or a number or a definition
 func lexString(l *lexer) stateFn {
-	log("lexString")
+	l.log("lexString")
 Loop:
 	for {
 		switch l.next() {
@@ -399,7 +417,9 @@ Loop:
 			case "null":
 				l.emit(itemNull)
 			default:
-				log("string is '" + word + "'")
+				if l.parser.Logger != nil {
+					l.log("string is '" + word + "'")
+				}
 				l.emit(itemString)
 			}
 			break Loop
@@ -413,25 +433,31 @@ Loop:
 
 // lex and parse at the same time. The assignment (e.g. '∆ =') has already been consumed.
 func lexDefinition(l *lexer) stateFn {
-	log("lexDefinition")
+	l.log("lexDefinition")
 	unit := strings.TrimSpace(l.input[l.start : l.pos-1])
+	line := l.startLine
 
 	l.acceptRun(" ")
 
 	if !l.accept("{") {
-		return l.errorf("Invalid assignment, expected '{")
+		l.skipUntil("\n") // the rest of the line is part of the invalid assignment
+		return l.errorf("Invalid assignment, expected '{'")
 	}
 
 	l.emit(itemAssignment) // ignored by the parser, for syntax highlighting only
 
 	props := make(map[string]string)
+	closed := false
 
 Loop:
 	for {
 		switch l.next() {
 		case eof:
-			return l.errorf("Expected '}' at the end of type definition") // TODO: more helpful error message
+			// keep the props we found so that uses of the type aren't reported as errors too
+			l.emitError("Expected '}' at the end of type definition") // TODO: more helpful error message
+			break Loop
 		case '}':
+			closed = true
 			break Loop
 		case ',':
 			l.emit(itemAssignment) // just ',', ignored by the parser, for syntax highlighting only
@@ -447,29 +473,21 @@ Loop:
 			}
 		default:
 			l.backup()
-			err, propName, propValue := l.scanProp()
-			if err != nil {
-				return err
+			if propName, propValue, ok := l.scanProp(); ok {
+				props[propName] = propValue
 			}
-			props[propName] = propValue
 		}
 	}
 
-	l.emit(itemAssignment) // just '}', ignored by the parser, for syntax highlighting only
+	if closed {
+		l.emit(itemAssignment) // just '}', ignored by the parser, for syntax highlighting only
+	}
 
 	// special logic: add the definition to the global map of UDTs now - lex it properly later
 	//definitionValue := l.input[l.start:l.pos]
-	l.UDTs[unit] = NewUDTFromDefinition(unit, props)
-
-	// if the new unit is a special character then update the rules of the lexer
-	switch unit {
-	case "-":
-		l.dashAllowed = false
-	case ".":
-		l.dotAllowed = false
-	case ":":
-		l.colonAllowed = false
-	}
+	t := newUDTFromDefinition(unit, props, l.parser.Logger)
+	t.origin = l.origin(line)
+	l.defineUDT(t)
 
 	//l.emit(itemDefinition)
 
@@ -477,22 +495,26 @@ Loop:
 }
 
 // Extract the prop name and value. Double quotes and spaces are ignored.
-func (l *lexer) scanProp() (stateFn, string, string) {
-	log("scanProp")
+// If the prop is invalid then an error is emitted, the rest of the prop is skipped, and ok is false.
+// Reaching EOF isn't reported here - the definition will report the missing '}'.
+func (l *lexer) scanProp() (propName string, propValue string, ok bool) {
+	l.log("scanProp")
 
 	start := l.pos
-	propName := ""
-	propValue := ""
 	// TODO: allow commas in quoted value
 Loop:
 	// look for an unescaped ':' to end of the prop name
 	for {
 		switch r := l.next(); r {
-		case eof, '}':
-			return l.errorf("Expected ':' at the end of prop name"), "", ""
+		case eof:
+			return "", "", false
+		case '}':
+			l.backup() // leave '}' to end the definition
+			l.emitError("Expected ':' at the end of prop name")
+			return "", "", false
 		//case '"', '`':
 		//	err := l.scanQuotedString(r)
-		//	log("finished scanning quoted string, " + string(l.peek()) + " is next.")
+		//	l.log("finished scanning quoted string, " + string(l.peek()) + " is next.")
 		//	if err != nil {
 		//		return err, "", ""
 		//	}
@@ -501,7 +523,9 @@ Loop:
 		case ':':
 			l.backup()
 			if start == l.pos {
-				return l.errorf("Prop name cannot be empty"), "", ""
+				l.skipUntil(",}")
+				l.emitError("Prop name cannot be empty")
+				return "", "", false
 			}
 			propName = l.input[start:l.pos]
 			break Loop
@@ -525,13 +549,14 @@ Loop:
 	}
 
 	start = l.pos
+	function := looksLikeFunction(l.input[l.pos:])
 
 Loop2:
 	// look for an unescaped ',' or '}' to end of the prop value
 	for {
 		switch r := l.next(); r {
 		case eof:
-			return l.errorf("Expected '}' at the end of definition"), "", ""
+			return "", "", false
 		//case '"', '`':
 		//	err := l.scanQuotedString(r)
 		//	if err != nil {
@@ -540,14 +565,18 @@ Loop2:
 		case '\\':
 			l.accept("},")
 		case '{': // possible js code block
-			err := l.scanJavaScript()
-			if err != nil {
-				return err, "", ""
+			if !l.scanJavaScript('}') {
+				return "", "", false
+			}
+		case '(', '[', '"', '\'', '`': // commas in brackets and strings are part of a function, e.g. (a, b) => [a, b]
+			if function && !l.scanJavaScript(r) {
+				return "", "", false
 			}
 		case ',', '}':
 			l.backup()
 			if start == l.pos {
-				return l.errorf("Prop value cannot be empty"), "", ""
+				l.emitError("Prop value cannot be empty")
+				return "", "", false
 			}
 			propValue = l.input[start:l.pos]
 			break Loop2
@@ -555,52 +584,92 @@ Loop2:
 	}
 	l.emit(itemPropValue) // ignored by the parser, for syntax highlighting only
 
-	return nil, propName, propValue
+	return propName, propValue, true
 }
 
-// scans a js code block following '{'
-func (l *lexer) scanJavaScript() stateFn {
-	log("scanJavaScript")
+// scans js code following an opening bracket or quote, i.e. a block, brackets, or a string
+// returns false and emits an error if it isn't closed
+func (l *lexer) scanJavaScript(open rune) bool {
+	l.log("scanJavaScript")
+
+	var end rune
+	switch open {
+	case '"', '\'', '`':
+		return l.scanQuotedString(open)
+	case '(':
+		end = ')'
+	case '[':
+		end = ']'
+	default:
+		end = '}'
+	}
 
 Loop:
-	// look for an unescaped '}' to end of the prop name
+	// look for the closing bracket, skipping over any nested brackets
 	for {
 		switch r := l.next(); r {
 		case eof:
-			return l.errorf("Expected '}' at the end of JavaScript")
-		case '{':
-			err := l.scanJavaScript() // recurse
-			if err != nil {
-				return err
-			}
-		case '"', '\'', '`': // don't end for } in string
-			err := l.scanQuotedString(r)
-			if err != nil {
-				return err
+			l.emitError("Expected '%s' at the end of JavaScript", string(end))
+			return false
+		case '{', '(', '[', '"', '\'', '`': // don't end for a closing bracket in nested brackets or strings
+			if !l.scanJavaScript(r) { // recurse
+				return false
 			}
-		case '}':
+		case end:
 			break Loop
 		}
 	}
-	return nil
+	return true
 }
 
-func (l *lexer) scanQuotedString(quoteChar rune) stateFn {
-	log("scanQuotedString")
-	log("started scanning quoted string, " + string(l.peek()) + " is next.")
+// looksLikeFunction returns true if a prop value starts like a JavaScript function, e.g. 'd =>', '(a, b) =>',
+// or 'function'. Brackets and strings in functions can contain commas that don't end the prop.
+func looksLikeFunction(value string) bool {
+	value = strings.TrimLeft(value, " \t\r\n")
+	if strings.HasPrefix(value, "function") || strings.HasPrefix(value, "async ") {
+		return true
+	}
+	end := 0 // end of the parameters
+	if strings.HasPrefix(value, "(") {
+		depth := 0
+		for end = 0; end < len(value); end++ {
+			if value[end] == '(' {
+				depth++
+			} else if value[end] == ')' {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+		end++
+	} else {
+		for end < len(value) && isAlphaNumeric(rune(value[end])) {
+			end++
+		}
+	}
+	return end > 0 && end <= len(value) && strings.HasPrefix(strings.TrimLeft(value[end:], " \t"), "=>")
+}
+
+// returns false and emits an error if the string isn't closed
+func (l *lexer) scanQuotedString(quoteChar rune) bool {
+	l.log("scanQuotedString")
+	if l.parser.Logger != nil {
+		l.log("started scanning quoted string, " + string(l.peek()) + " is next.")
+	}
 
 Loop:
 	for {
 		switch l.next() {
 		case eof:
-			return l.errorf("Expected '" + string(quoteChar) + "', found EOF")
-			// absorb
+			l.emitError("Expected '%s', found EOF", string(quoteChar))
+			return false
 		case '\\':
 			if l.next() == quoteChar {
 				// absorb escaped quote
-				log("found escaped quote")
+				l.log("found escaped quote")
 			} else {
-				log("found stray backslash")
+				l.log("found stray backslash")
 				l.backup() // backslash is absorbed
 			}
 		case quoteChar:
@@ -608,7 +677,7 @@ Loop:
 		}
 
 	}
-	return nil
+	return true
 }
 
 // scans something that could be a UDT, an invalid UDT, or a string
@@ -616,48 +685,52 @@ Loop:
 // it could also be a definition
 // We have not consumed any characters
 func lexUDT(l *lexer) stateFn {
-	log("lexUDT")
+	l.log("lexUDT")
 
 	if isNumeric(l.peek()) { // if starts with quantity - scan the number then the unit (it could also be a string that starts with a number)
 		if l.scanNumber(true) {
-			l.emit(itemUDT)
+			l.emitUDT()
 			return lexBb
 		} else if l.scanNumber(false) { // not a DT so must be a number or a string
 			l.emit(itemNumber)
 			return lexBb
 		} else {
-			log("number is actually a string that starts with a number")
+			l.log("number is actually a string that starts with a number")
 			return lexString
 		}
 	} else if l.scanUnit() { // must start with a unit, or could be string or identifier
 
-		log("DT with no quantity")
+		l.log("DT with no quantity")
 
+		valueStart := l.pos
 		if !l.scanValue() { // next thing could be a value or nothing
-			log("removing unit from instances")
-			l.udtInstances = l.udtInstances[:len(l.udtInstances)-1]
-			l.emit(itemError) // modifier has an invalid value
+			l.log("discarding udt")
+			l.udt = nil
+			l.emitError("Invalid value, expected closing quote")
 			return lexBb
 		}
+		l.udt.value = Span{valueStart, l.pos}
 		if !l.scanModifier() { // next thing could be a modifier or nothing
-			log("removing unit from instances")
-			l.udtInstances = l.udtInstances[:len(l.udtInstances)-1]
-			l.emit(itemError) // modifier has an invalid value
+			l.log("discarding udt")
+			l.udt = nil
+			l.emitError("Invalid modifier value, expected closing quote") // modifier has an invalid value
 			return lexBb
 		}
 
-		l.emit(itemUDT)
+		l.emitUDT()
 
 		return lexBb
 	} else { // not a udt - could be string or identifier
-		log("started like a UDT but wasn't. " + string(l.peek()) + " is next")
+		if l.parser.Logger != nil {
+			l.log("started like a UDT but wasn't. " + string(l.peek()) + " is next")
+		}
 		if isNumeric(l.peek()) {
-			if verbose {
+			if l.parser.Logger != nil {
 				return l.errorf("This shouldn't happen: DT was found to be a number after scanning for numbers")
 			}
 			return lexNumber
 		} else {
-			log("must be a definition or key word")
+			l.log("must be a definition or key word")
 			return lexIdentifier
 		}
 	}
@@ -669,9 +742,9 @@ func lexUDT(l *lexer) stateFn {
 // strconv) will notice.
 func lexNumber(l *lexer) stateFn {
 	//start := l.pos
-	log("lexNumber")
+	l.log("lexNumber")
 	if !l.scanNumber(false) {
-		log("number is actually a string that starts with a number")
+		l.log("number is actually a string that starts with a number")
 		//l.pos = start
 		return lexString
 		//return l.errorf("bad number syntax: %q", l.input[l.start:l.pos])
@@ -682,7 +755,7 @@ func lexNumber(l *lexer) stateFn {
 
 // check if the next few chars could be a UDT unit - backtrack if not
 func (l *lexer) scanUnit() bool {
-	log("scanUnit")
+	l.log("scanUnit")
 
 	start := l.pos
 	word := ""
@@ -694,7 +767,7 @@ Loop:
 		switch r := l.next(); {
 		//case !(isSpace(r) || isNumeric(r) || isQuoteChar(r) || r == '='):  // if non unit character
 		case !isSpace(r):
-			log(string(r))
+			l.log(string(r))
 			// absorb
 		default:
 			l.backup()
@@ -726,34 +799,30 @@ Loop:
 
 	// find the longest unit that matches this word - UDTs take priority over PDTs even if they're shorter
 	// e.g. UDTs are `W`. Input is `Wb`. Assumed to be [`W`, `b`].
-	log("looking for a unit to match '" + word + "'")
-
-	bestUnit := ""
-
-	for unit := range l.UDTs {
-		if strings.HasPrefix(word, unit) && len(unit) > len(bestUnit) {
-			log("it could be UDT '" + unit + "'")
-			bestUnit = unit
-		}
+	if l.parser.Logger != nil {
+		l.log("looking for a unit to match '" + word + "'")
 	}
 
+	udtUnits, pdtUnits := l.units()
+	bestUnit := udtUnits.longestPrefix(word)
 	if bestUnit == "" {
-		for unit := range l.PDTs {
-			if strings.HasPrefix(word, unit) && len(unit) > len(bestUnit) {
-				log("it could be PDT '" + unit + "'")
-				bestUnit = unit
-			}
-		}
+		bestUnit = pdtUnits.longestPrefix(word)
 	}
 
 	if bestUnit != "" {
-		log("unit is " + bestUnit)
-		// now we know what the unit is, store so we know which units we have later - speeds up parsing
-		l.udtInstances = append(l.udtInstances, bestUnit)
+		if l.parser.Logger != nil {
+			l.log("unit is " + bestUnit)
+		}
+		// now we know what the unit is, store it with the rest of the parts we find - speeds up parsing
+		l.udt = &udtParts{
+			t:        l.lookup(bestUnit),
+			quantity: Span{l.start, start},
+			unit:     Span{start, start + Pos(len(bestUnit))},
+		}
 		l.pos = start + Pos(len(bestUnit)) // backtrack to the end of the unit
 		return true
 	} else {
-		log("it's not a known unit")
+		l.log("it's not a known unit")
 		l.pos = start // backtrack
 		return false  // unit found did not match any known unit - could be a string
 	}
@@ -766,9 +835,9 @@ func (l *lexer) scanNumber(udt bool) bool {
 	startPos := l.pos
 
 	if udt {
-		log("scanUDT (scanNumber)")
+		l.log("scanUDT (scanNumber)")
 	} else {
-		log("scanNumber")
+		l.log("scanNumber")
 	}
 	l.accept("-") // Optional leading sign. bb does not allow leading +
 	l.acceptRun("0123456789")
@@ -784,14 +853,16 @@ func (l *lexer) scanNumber(udt bool) bool {
 			return false     // if there's no unit now then it's not a DT (it's a number)
 		}
 
+		valueStart := l.pos
 		if !l.scanValue() {
-			log("removing unit from instances")
-			l.udtInstances = l.udtInstances[:len(l.udtInstances)-1]
+			l.log("discarding udt")
+			l.udt = nil
 			return false
 		} // if there's no value that's fine
+		l.udt.value = Span{valueStart, l.pos}
 		if !l.scanModifier() {
-			log("removing unit from instances")
-			l.udtInstances = l.udtInstances[:len(l.udtInstances)-1]
+			l.log("discarding udt")
+			l.udt = nil
 			return false
 		} // scans until we get to an unknown modifier (start of something else)
 		return true
@@ -809,12 +880,9 @@ func (l *lexer) scanNumber(udt bool) bool {
 // stops when the next character isn't part of the same DT
 // returns false if invalid
 func (l *lexer) scanModifier() bool {
-	log("scanModifier")
-
-	udt := l.udtInstances[len(l.udtInstances)-1]
-	rawModifiers := map[string][]string{}
+	l.log("scanModifier")
 
-	l.modifierInstances = append(l.modifierInstances, rawModifiers) // initialise map to store modifiers
+	udt := l.udt.t
 
 	modifierStart := l.pos
 
@@ -830,42 +898,28 @@ Loop: // loop for multiple modifier/value pairs
 			// TODO: check for dot not followed by number or dash not followed by number or dot then number
 			// check it's a known modifier
 
-			m := l.input[modifierStart:l.pos]
-			backtrackCharacters := 0
-
-		LoopBacktrack:
-			for { // loop for multiple lengths of modifier, i.e. #>? then #> then #
-
-				if len(m) == backtrackCharacters {
-					log("nothing matches " + m)
-					break LoopBacktrack // if we've already looked for modifiers of length 1 then give up
-				} else {
-					m2 := m[:len(m)-backtrackCharacters]
-
-					for _, modifier := range (l.UDTs[udt]).getModifiers() { // get all the modifiers for the current type
-						if modifier == m2 {
-							l.pos = l.pos - Pos(backtrackCharacters)
-							log("modifier is: \033[92m" + m2 + "\033[0m")
-							if !l.scanValue() {
-								log("value is invalid")
-								return false
-							} else {
-								log("value is \033[92m" + l.input[modifierStart+Pos(len(m2)):l.pos] + "\033[0m")
-								if rawModifiers[m2] == nil {
-									// initialise slice of modifier values
-									rawModifiers[m2] = []string{}
-								}
-								rawModifiers[m2] = append(rawModifiers[m2], l.input[modifierStart+Pos(len(m2)):l.pos]) // store the modifier and value we've found
-								// keep going - onto the next modifier
-								modifierStart = l.pos
-								continue Loop
-							}
-						}
-					}
-					log("Couldn't find a match for " + m2)
-					// if there are no matches - look for a shorter modifier
-					backtrackCharacters += 1
+			// find the longest modifier the text starts with, i.e. #>? then #> then #
+			if m := udt.modifiers.longestPrefix(l.input[modifierStart:l.pos]); m != "" {
+				nameEnd := modifierStart + Pos(len(m))
+				l.pos = nameEnd
+				if l.parser.Logger != nil {
+					l.log("modifier is: " + m)
+				}
+				if !l.scanValue() {
+					l.log("value is invalid")
+					return false
 				}
+				if l.parser.Logger != nil {
+					l.log("value is " + l.input[nameEnd:l.pos])
+				}
+				// store the modifier and value we've found
+				l.udt.modifiers = append(l.udt.modifiers, modifierPart{Span{modifierStart, nameEnd}, Span{nameEnd, l.pos}})
+				// keep going - onto the next modifier
+				modifierStart = l.pos
+				continue Loop
+			}
+			if l.parser.Logger != nil {
+				l.log("nothing matches " + l.input[modifierStart:l.pos])
 			}
 
 			// if there are still no matches - reset then stop (assume the next character is part of something else)
@@ -875,17 +929,16 @@ Loop: // loop for multiple modifier/value pairs
 			l.next()
 		}
 	}
-
-	return true
 }
 
 // values of modifiers can be numbers, quoted strings, or structures TODO JSON (structure)
 // returns false if invalid
 func (l *lexer) scanValue() bool {
-	currentUdtUnit := l.udtInstances[len(l.udtInstances)-1]
-	log("scanValue for " + currentUdtUnit)
+	currentUdt := l.udt.t
+	if l.parser.Logger != nil {
+		l.log("scanValue for " + currentUdt.Unit)
+	}
 
-	currentUdt := l.UDTs[currentUdtUnit]
 	//currentUdt.getModifiers()
 	// TODO: refactor: get the UDT instance that we're lexing and
 	// TODO: colonAllowed should be a property of UDTs as well in case of modifiers
@@ -914,9 +967,9 @@ Loop:
 		case quoted && r == '\\':
 			if l.next() == quoteChar {
 				// absorb escaped quote
-				log("found escaped quote")
+				l.log("found escaped quote")
 			} else {
-				log("found stray backslash")
+				l.log("found stray backslash")
 				l.backup() // backslash is absorbed
 			}
 		case quoted && r != quoteChar && r != eof:
@@ -950,7 +1003,7 @@ Loop:
 						return true
 					} else {
 						// Otherwise, it's an invalid value
-						log("Unescaped value! Invalid!")
+						l.log("Unescaped value! Invalid!")
 						return false
 					}
 				}
@@ -974,7 +1027,7 @@ Loop:
 
 // lexQuote scans a quoted string.
 func lexQuote(l *lexer) stateFn {
-	log("lexQuote")
+	l.log("lexQuote")
 
 Loop:
 	for {
@@ -985,6 +1038,7 @@ Loop:
 			}
 			fallthrough
 		case eof, '\n':
+			l.backup() // the newline isn't part of the string
 			return l.errorf("unterminated quoted string")
 		case '"':
 			break Loop
@@ -996,7 +1050,7 @@ Loop:
 
 // lexRawQuote scans a raw quoted string.
 func lexRawQuote(l *lexer) stateFn {
-	log("lexRawQuote")
+	l.log("lexRawQuote")
 
 Loop:
 	for {
@@ -1041,10 +1095,15 @@ func isAlphaNumeric(r rune) bool {
 	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
 }
 
+// Preview prints the input with each item highlighted according to how bb interprets it.
 func Preview(input string) {
-	l := lex(input)
-	idx := 0 // keep track of which udt we're looking at
-	for item := range l.items {
+	NewParser().Preview(input)
+}
+
+// Preview prints the input with each item highlighted according to how bb interprets it.
+func (p *Parser) Preview(input string) {
+	l := lex(input, p.registry.clone(), p)
+	for item, ok := l.nextItem(); ok; item, ok = l.nextItem() {
 
 		colour := "" // https://en.wikipedia.org/wiki/ANSI_escape_code#3-bit_and_4-bit
 		if item.typ == itemUDT {
@@ -1072,11 +1131,11 @@ func Preview(input string) {
 
 		if item.typ == itemUDT {
 
-			unit := l.udtInstances[idx]
-			idx += 1
-			halves := strings.SplitN(item.val, unit, 2) // split into quantity and everything else
+			unit := item.udt.unit
+			quantity := l.input[item.pos:unit.Start]
+			rest := l.input[unit.Stop : item.pos+Pos(len(item.val))] // everything after the unit
 
-			fmt.Print("\033[", colour, "m", halves[0], "\033[1m", "\033[94m", unit, "\033[0m", "\033[", colour, "m", halves[1], "\033[0m")
+			fmt.Print("\033[", colour, "m", quantity, "\033[1m", "\033[94m", l.input[unit.Start:unit.Stop], "\033[0m", "\033[", colour, "m", rest, "\033[0m")
 
 		} else {
 			fmt.Print("\033[", colour, "m", item.val, "\033[0m")
@@ -1084,46 +1143,78 @@ func Preview(input string) {
 	}
 }
 
-func (l *lexer) ParseUDT(input string) interface{} {
-	unit := l.udtInstances[l.instanceIndex]
+// ParseUDT converts a UDT item to its value. The errors are from script props that failed.
+func (l *lexer) ParseUDT(item item) (interface{}, []error) {
+	var source map[string]interface{}
+	if l.parser.Source || len(item.udt.t.ScriptProps) > 0 {
+		source = l.source(item)
+	}
+	instance := newUDTInstance(l.input, item)
+	t := item.udt.t
+	for _, m := range instance.Modifiers {
+		if !t.isHidden(m.Name) {
+			t = l.ownType(t) // parsing will hide the modifier's prop, which mustn't change the parser's types
+			break
+		}
+	}
+	return parseUDT(instance, t, l.scripts, source)
+}
+
+// source describes where an item was found: its text, line, column (in runes), and byte offset. Script props are
+// given it as their second argument, and it's added to values as '_source' if the parser asks for it.
+func (l *lexer) source(item item) map[string]interface{} {
+	return map[string]interface{}{
+		"text":   strings.TrimSpace(item.val),
+		"line":   item.line,
+		"column": columnOf(l.input, item.pos),
+		"offset": l.offset + int(item.pos),
+	}
+}
 
-	defer func() {
-		l.instanceIndex++
-	}()
+// origin describes where a type defined on a line of the input comes from, e.g. "types.bb:3".
+func (l *lexer) origin(line int) string {
+	if l.name == "" {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("%s:%d", l.name, line)
+}
 
-	t := l.UDTs[unit]
-	if t == nil {
-		t = l.PDTs[unit]
+// lookup returns the type for a unit. UDTs take priority over PDTs.
+func (l *lexer) lookup(unit string) *udt {
+	if t, ok := l.UDTs[unit]; ok {
+		return t
 	}
-	return ParseUDT(input, t, l.modifierInstances[l.instanceIndex])
+	return l.PDTs[unit]
 }
 
 // Syntax returns all items from the input and what colour they should be as a JSON object
 func Syntax(input string) map[string]interface{} {
-	l := lex(input)
+	return NewParser().Syntax(input)
+}
+
+// Syntax returns all items from the input and what colour they should be as a JSON object
+func (p *Parser) Syntax(input string) map[string]interface{} {
+	l := lex(input, p.registry.clone(), p)
 
 	classes := make([]interface{}, 0)
 	output := make([]interface{}, 0)
 
-	for item := range l.items {
+	for item, ok := l.nextItem(); ok; item, ok = l.nextItem() {
 
 		switch item.typ {
 		case itemUDT:
 
-			unit := l.udtInstances[l.instanceIndex]
-			data := l.ParseUDT(item.val)
+			unit := item.udt.t.Unit
+			data, _ := l.ParseUDT(item)
 
 			udt := make([]interface{}, 0)
-			log(item.val)
+			l.log(item.val)
 
-			halves := strings.SplitN(item.val, unit, 2) // split into quantity and everything else
-			quantity := halves[0]
+			quantity := l.input[item.pos:item.udt.unit.Start]
 			udt = append(udt, map[string]interface{}{"class": "quantity", "value": quantity})
 			udt = append(udt, map[string]interface{}{"class": "unit", "value": unit})
 			// TODO: split everything else into modifiers and values
-			if len(halves) > 1 {
-				udt = append(udt, map[string]interface{}{"class": "value", "value": halves[1]})
-			}
+			udt = append(udt, map[string]interface{}{"class": "value", "value": l.input[item.udt.unit.Stop : item.pos+Pos(len(item.val))]})
 			// TODO: modifiers
 			//for modifierUnit, modifierValue := range(modifiers) {
 			//  output = append(output, map[string]interface{}{ "class": "modifier modifier-" + modifierUnit + " modifierUnit", "value": modifierValue })
@@ -0,0 +1,88 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Logger receives detailed trace messages from the lexer and parser, e.g. each rune the lexer reads and each state
+// it enters. The messages logged for each word and value are only built when a Parser has a Logger, so parsing
+// without one doesn't pay for them.
+//
+// A Logger may be used by several parses at once, so it should be safe to call from multiple goroutines.
+type Logger interface {
+	Log(entry LogEntry)
+}
+
+// LogEntry is a trace message. Line and Offset are where the lexer was when the message was logged, or 0 if it
+// was logged while converting a value rather than while lexing.
+type LogEntry struct {
+	Line    int    `json:"line,omitempty"`
+	Offset  int    `json:"offset,omitempty"`
+	Message string `json:"message"`
+}
+
+// log sends a message to the logger if there is one.
+func log(logger Logger, message string) {
+	if logger != nil {
+		logger.Log(LogEntry{Message: message})
+	}
+}
+
+// log sends a message to the parser's logger if there is one, with the current position of the lexer.
+func (l *lexer) log(message string) {
+	if l.parser.Logger != nil {
+		l.parser.Logger.Log(LogEntry{Line: l.line, Offset: int(l.pos), Message: message})
+	}
+}
+
+// NewTextLogger returns a Logger that writes messages to w as colour highlighted text, for reading in a terminal.
+// Each rune the lexer reads is highlighted in blue and each state in green, and a line is started for each item.
+func NewTextLogger(w io.Writer) Logger {
+	return &textLogger{w: w}
+}
+
+type textLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (t *textLogger) Log(entry LogEntry) {
+	message := entry.Message
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(message) == 1 {
+		if message == "\n" {
+			message = "\\n"
+		}
+		fmt.Fprint(t.w, "/\033[94m", message, "\033[0m")
+	} else if message == "lexBb" {
+		fmt.Fprint(t.w, "\n\033[92m", message, "\033[0m")
+	} else if strings.HasPrefix(message, "lex") {
+		fmt.Fprint(t.w, "/\033[92m", message, "\033[0m")
+	} else {
+		fmt.Fprint(t.w, "/", message)
+	}
+}
+
+// NewJSONLogger returns a Logger that writes each message to w as a JSON object on its own line, for tools to read.
+func NewJSONLogger(w io.Writer) Logger {
+	return &jsonLogger{encoder: json.NewEncoder(w)}
+}
+
+type jsonLogger struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func (j *jsonLogger) Log(entry LogEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_ = j.encoder.Encode(entry) // there's nowhere to report a failure to write a trace message
+}
@@ -1,37 +1,30 @@
 package parser
 
+import "strings"
 
 // lex creates a new scanner for the input string.
-func lexInjectionMode(input string) string {
+func lexInjectionMode(input string, p *Parser) string {
 
   l := &lexer{
     name:        "bb",
     input:       input + "\n",
-    items:       make(chan item),
     line:        1,
     startLine:   1,
+    state:       lexInjection,
+    parser:      p,
   }
-  go l.injectionModeRun()
 
-  injectedInput := ""
+  var injectedInput strings.Builder
 
-  for item := range l.items {
-    injectedInput += item.val
+  for item, ok := l.nextItem(); ok; item, ok = l.nextItem() {
+    injectedInput.WriteString(item.val)
   }
 
-  log("injectedInput")
-  log(injectedInput)
-  log("\n---------------------------------------------")
+  l.log("injectedInput")
+  l.log(injectedInput.String())
+  l.log("\n---------------------------------------------")
 
-  return injectedInput
-}
-
-// run runs the state machine for the lexer in comment mode.
-func (l *lexer) injectionModeRun() {
-  for state := lexInjection; state != nil; {
-    state = state(l)
-  }
-  close(l.items)
+  return injectedInput.String()
 }
 
 /* look through non-bb file for comments that start with bb, e.g.:
@@ -49,8 +42,8 @@ func (l *lexer) injectionModeRun() {
 Keep going until we find one of these
 */
 func lexInjection(l *lexer) stateFn {
-  log("lexInjection")
-  log(string(l.peek()))
+  l.log("lexInjection")
+  l.log(string(l.peek()))
 
   switch r := l.next(); {
   case r == eof:
@@ -61,7 +54,9 @@ func lexInjection(l *lexer) stateFn {
 
 
       prefix := string(r) + (l.input + "     ")[l.pos:l.pos + 5]  // take the next 6 characters - pad the input so I don't have to check it's long enough to slice
-      log("comment prefix is: " + prefix)
+      if l.parser.Logger != nil {
+        l.log("comment prefix is: " + prefix)
+      }
 
       if prefix == "<!--bb" { // look for multiline with length 6 prefix
         l.pos += 5
@@ -98,32 +93,34 @@ func lexInjection(l *lexer) stateFn {
 
 // injected bb that can only be on one line
 func lexInlineInjection(l *lexer) stateFn {
-  log("lexInlineInjection")
+  l.log("lexInlineInjection")
   for {
     if r := l.next(); r == '\n' || r == eof {
       l.emit(itemString)
       return lexInjection
     } else {
-      log(string(l.peek()))
+      l.log(string(l.peek()))
     }
   }
 }
 
 // injected bb that can be on multiple lines and must end with a specific suffix
 func (l *lexer) scanMultilineInjection(suffix string) stateFn {
-  log("scanMultilineInjection")
-  log("suffix is: " + suffix)
-  log("looking for: " + string(rune(suffix[0])))
+  l.log("scanMultilineInjection")
+  if l.parser.Logger != nil {
+    l.log("suffix is: " + suffix)
+    l.log("looking for: " + string(rune(suffix[0])))
+  }
   for {
     if r := l.next(); r == rune(suffix[0]) {
 
       for _, s := range suffix[1:] {
-        log(string(rune(s)))
+        l.log(string(rune(s)))
         if l.next() == rune(s) {
-          log("is in the suffix")
+          l.log("is in the suffix")
           // absorb
         } else {
-          log("is not part of the suffix")
+          l.log("is not part of the suffix")
           break
         }
       }
@@ -134,10 +131,10 @@ func (l *lexer) scanMultilineInjection(suffix string) stateFn {
      l.pos += Pos(len(suffix))
      return lexInjection
     } else if r == eof {
-      log("Found EOF before comment suffix - fail silently")
+      l.log("Found EOF before comment suffix - fail silently")
       return lexInjection  // unclosed comment - fail silently
     } else {
-      log(string(l.peek()))
+      l.log(string(l.peek()))
     }
   }
 }
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 func removeQuotes(s string) string {
@@ -19,55 +21,200 @@ func removeQuotes(s string) string {
 	return s
 }
 
+// Parser converts bb to data. Types defined with Define are available to every input it parses afterwards, so
+// shared definitions only need to be lexed once. Types defined within an input are only available to that input.
+//
+// Parse can be called from multiple goroutines at once, but not at the same time as the Define methods or
+// RegisterFunc.
+type Parser struct {
+	// Table enables table mode, where each line is converted to a row (a slice of cells) and tabs or runs of two
+	// or more spaces separate the cells.
+	Table bool
+
+	// Strict reports values that couldn't be converted as errors, e.g. a script prop that throws an exception.
+	// Otherwise they are converted to null.
+	Strict bool
+
+	// ScriptTimeout is how long a script prop can run for before it fails, or 0 for no limit.
+	ScriptTimeout time.Duration
+
+	// MaxScriptOutput is the largest result a script prop can have when converted to JSON, in bytes, or 0 for no
+	// limit. Scripts that build a larger result fail.
+	MaxScriptOutput int
+
+	// NoScripts disables script props, e.g. for bb from an untrusted source. Their values are kept as strings, and
+	// are reported as errors in strict mode.
+	NoScripts bool
+
+	// Source adds where each UDT instance was found to its value as '_source': the raw text, line, column, and
+	// byte offset. Script props can see this as their second argument either way.
+	Source bool
+
+	// NoFileImports disables imports of files, e.g. '// import ./types.bb', for bb from an untrusted source, which
+	// could otherwise read any bb file. They are reported as errors. Collections can still be imported.
+	NoFileImports bool
+
+	// RestrictImports only allows imports of files in Dir or its subdirectories, including imports in imported
+	// files. Others are reported as errors.
+	RestrictImports bool
+
+	// Dir is the directory that imports of files in the input, e.g. '// import ./types.bb', are resolved against,
+	// or "" for the working directory. Imports in imported files are resolved against the directory of that file.
+	Dir string
+
+	// DefinitionsName is where the input to Define, DefineJSON and DefineYAML comes from, e.g. its file name, which
+	// is used for the origins of the types it defines - see Types. "" uses "definitions", "JSON definitions" or
+	// "YAML definitions".
+	DefinitionsName string
+
+	// Logger receives detailed trace messages while parsing, or nil for none.
+	Logger Logger
+
+	registry *registry
+	funcs    map[string]interface{} // Go functions that scripts can call - see RegisterFunc
+	files    map[string]string      // the contents of imported files, so they're only read once
+	filesMu  sync.Mutex
+}
+
+// NewParser returns a Parser that only knows the pre-defined types. Script props can run for up to a second,
+// and their results can be up to 1MB.
+func NewParser() *Parser {
+	return &Parser{
+		ScriptTimeout:   time.Second,
+		MaxScriptOutput: 1 << 20,
+		registry:        newRegistry(),
+	}
+}
+
+// Define adds the type definitions, imports and transforms in the input to the parser. Anything else in the input is
+// ignored.
+func (p *Parser) Define(input string) ErrorList {
+	l := lex(input, p.registry, p)
+	l.name = p.definitionsName("definitions")
+
+	var errs ErrorList
+	for item, ok := l.nextItem(); ok; item, ok = l.nextItem() {
+		if item.typ == itemError {
+			errs = append(errs, newError(l.input, item))
+		}
+	}
+	p.registry.units() // build the unit tries now, so that every parse can share them
+
+	return errs
+}
+
+// definitionsName is the name used for the origins of defined types, or name if DefinitionsName isn't set.
+func (p *Parser) definitionsName(name string) string {
+	if p.DefinitionsName != "" {
+		return p.DefinitionsName
+	}
+	return name
+}
+
+// Parse converts bb to a slice of values. Invalid input is skipped - use ParseWithErrors to find out what went wrong.
 func Parse(input string) []interface{} {
+	data, _ := ParseWithErrors(input)
+	return data
+}
 
-	l := lex(input)
+// ParseWithErrors converts bb to a slice of values, and returns every error found in the input.
+func ParseWithErrors(input string) ([]interface{}, ErrorList) {
+	return NewParser().Parse(input)
+}
 
-	//data := make([]interface{}, 0)
-	row := make([]interface{}, 0) // TODO row logic
-	for item := range l.items {
-		if item.typ == itemNumber {
-			number, err := strconv.ParseFloat(item.val, 64)
-			if err != nil {
-				row = append(row, item.val) // if number doesn't parse keep as string
-			} else {
-				row = append(row, number)
-			}
-		} else if item.typ == itemTab {
-			// todo
-		} else if item.typ == itemNewline {
-			// todo
-		} else if item.typ == itemString {
-			row = append(row, strings.TrimSpace(removeQuotes(item.val)))
-		} else if item.typ == itemBool {
-			if item.val == "true" {
-				row = append(row, true)
-			} else {
-				row = append(row, false)
-			}
-		} else if item.typ == itemNull {
-			row = append(row, nil)
-		} else if item.typ == itemUDT {
-			row = append(row, l.ParseUDT(item.val))
-		} else {
-			// definitions, comments, and spaces are ignored
+// Parse converts bb to a slice of values, and returns every error found in the input. The transforms defined in the
+// input, or with Define, are run on the values once the whole input has been parsed.
+func (p *Parser) Parse(input string) ([]interface{}, ErrorList) {
+
+	l := lex(input, p.registry.clone(), p)
+
+	var errs ErrorList
+	data := make([]interface{}, 0)
+	rows := newTable()
+	for item, ok := l.nextItem(); ok; item, ok = l.nextItem() {
+		if item.typ == itemError {
+			errs = append(errs, newError(l.input, item))
+		} else if p.Table {
+			errs = p.valueErrors(errs, l, item, rows.add(l, item))
+		} else if value, ok, valueErrs := l.value(item); ok {
+			data = append(data, value)
+			errs = p.valueErrors(errs, l, item, valueErrs)
+		}
+	}
+
+	if p.Table {
+		data = rows.finish()
+	}
+	data, transformErrs := p.transform(l.registry, l.scripts, data)
+	return data, append(errs, transformErrs...)
+}
+
+// valueErrors appends the errors from converting an item to errs in strict mode. Otherwise they're ignored.
+func (p *Parser) valueErrors(errs ErrorList, l *lexer, item item, valueErrs []error) ErrorList {
+	if p.Strict {
+		for _, err := range valueErrs {
+			errs = append(errs, newValueError(l.input, item, err))
 		}
 	}
+	return errs
+}
 
-	return row
+// value converts an item to the value it represents. ok is false if the item doesn't have a value.
+// If parts of the value couldn't be converted then errs says why, and those parts of the value are nil.
+func (l *lexer) value(item item) (value interface{}, ok bool, errs []error) {
+	switch item.typ {
+	case itemNumber:
+		number, err := strconv.ParseFloat(item.val, 64)
+		if err != nil {
+			return item.val, true, nil // if number doesn't parse keep as string
+		}
+		return number, true, nil
+	case itemString:
+		return strings.TrimSpace(removeQuotes(item.val)), true, nil
+	case itemBool:
+		return item.val == "true", true, nil
+	case itemNull:
+		return nil, true, nil
+	case itemUDT:
+		value, errs := l.ParseUDT(item)
+		return value, true, errs
+	default:
+		// definitions, comments, and spaces are ignored - tabs and newlines are only used in table mode
+		return nil, false, nil
+	}
 }
 
+// ParseInjectionMode converts bb found within the comments of another language.
 func ParseInjectionMode(input string) []interface{} {
-	injectedInput := lexInjectionMode(input)
+	data, _ := ParseInjectionModeWithErrors(input)
+	return data
+}
+
+// ParseInjectionModeWithErrors is like ParseWithErrors for bb found within the comments of another language.
+// Error positions refer to the bb extracted from the comments, not to the original input.
+func ParseInjectionModeWithErrors(input string) ([]interface{}, ErrorList) {
+	return NewParser().ParseInjectionMode(input)
+}
 
-	return Parse(injectedInput)
+// ParseInjectionMode converts bb found within the comments of another language, and returns every error found.
+// Error positions refer to the bb extracted from the comments, not to the original input.
+func (p *Parser) ParseInjectionMode(input string) ([]interface{}, ErrorList) {
+	injectedInput := lexInjectionMode(input, p)
+
+	return p.Parse(injectedInput)
 }
 
+// Debug prints every item in the input along with its type and value when converted to JSON.
 func Debug(input string) {
+	NewParser().Debug(input)
+}
+
+// Debug prints every item in the input along with its type and value when converted to JSON.
+func (p *Parser) Debug(input string) {
 
-	l := lex(input)
+	l := lex(input, p.registry.clone(), p)
 
-	for item := range l.items {
+	for item, ok := l.nextItem(); ok; item, ok = l.nextItem() {
 		typeName := ""
 		value := ""
 		jsonString := ""
@@ -83,7 +230,7 @@ func Debug(input string) {
 		case itemUDT:
 			typeName = "\nUDT"
 			value = item.val
-			data := l.ParseUDT(item.val)
+			data, _ := l.ParseUDT(item)
 			j, err := json.Marshal(data)
 			if err != nil {
 				panic(err)
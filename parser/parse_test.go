@@ -1,8 +1,16 @@
 package parser
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testCase struct {
@@ -24,10 +32,26 @@ var testCases = []testCase{
 	{"repeated modifier bool", `∆ = {+:f} ∆+++`, `[{"f":[true,true,true]}]`},
 	{"si units", "// import si\n50g 234T 23Bq 77l", `[{"quantity":50,"type":"weight","unit":"gram"},{"quantity":234,"type":"magnetic flux density","unit":"tesla"},{"quantity":23,"type":"radioactivity","unit":"becquerel"},{"quantity":77,"type":"volume","unit":"litre"}]`},
 	{"currency", "// import currency\n$500 £10 50GBP 0.12BTC", `[{"type":"money","unit":"United States dollar","value":500},{"type":"money","unit":"British pound","value":10},{"quantity":50,"type":"money","unit":"British pound"},{"quantity":0.12,"type":"money","unit":"Bitcoin"}]`},
+	{"namespaced import", "// import si as si.\n3si.kg 2kg", `[{"quantity":3,"type":"weight","unit":"kilogram"},"2kg"]`},
+	{"selective imports", "// import si only kg, m\n// import currency except USD\n3kg 2s 5USD £5", `[{"quantity":3,"type":"weight","unit":"kilogram"},"2s","5USD",{"type":"money","unit":"British pound","value":5}]`},
+	{"longest unit", "// import si\n3Wb 2W 4min 5m", `[{"quantity":3,"type":"magnetic flux","unit":"weber"},{"quantity":2,"type":"power","unit":"watt"},{"quantity":4,"type":"time","unit":"minute"},{"quantity":5,"type":"length","unit":"metre"}]`},
+	{"udt before longer pdt", "// import si\nW = {t: w} 3Wb", `[{"quantity":3,"t":"w"},"b"]`},
+	{"longest modifier", `∆ = {#:a, #>:b, #>?:c} ∆#>?1#>2#3 ∆#>>`, `[{"a":3,"b":2,"c":1},{"b":true},"\u003e"]`},
 	{"script props", `∆={g:g,f:d =>d.value+d.g} ∆1g3 ∆"goo"g"foo" ∆"ya"g0g1g2 ∆`, `[{"f":4,"g":3,"value":1},{"f":"goofoo","g":"foo","value":"goo"},{"f":"ya0,1,2","g":[0,1,2],"value":"ya"},{"f":null}]`},
 
+	{"block body script", "∆ = { area: d => { const half = (a, b) => a * b / 2; return half(d.quantity, d.value) } } 3∆4", `[{"area":6,"quantity":3,"value":4}]`},
+	{"modern script syntax", "∆ = { label: ({quantity, value}) => `${quantity}, ${value}`, f: function (d) { return [d.value, 1] } } 3∆4", `[{"f":[4,1],"label":"3, 4","quantity":3,"value":4}]`},
+	{"arrows in strings", `∆ = { a: d => "=>", b: "=> not a function" } ∆`, `[{"a":"=\u003e","b":"=\u003e not a function"}]`},
+	{"yaml with non-string keys", "yaml`1: a\ntrue: b\nc: {2: d}`", `[{"1":"a","c":{"2":"d"},"true":"b"}]`},
+	{"toml", "toml`a = 1\n[b]\nc = [\"x\"]`", `[{"a":1,"b":{"c":["x"]}}]`},
+	{"csv", "csv`name, qty\napple, 3\npear, 4`", `[[{"name":"apple","qty":"3"},{"name":"pear","qty":"4"}]]`},
+	{"xml", "xml`<a x=\"1\"><b>2</b><b>3</b>text</a>`", `[{"a":{"#text":"text","@x":"1","b":["2","3"]}}]`},
+	{"ini", "ini`top = 1\n; comment\n[s]\nk: \"v\"`", `[{"s":{"k":"v"},"top":"1"}]`},
+	{"invalid ini", "ini`oops`", `[{"type":"error","unit":"ini","value":"oops","error":"line 1: expected 'key = value'"}]`},
+	{"bb helpers", `∆ = { +: n, total: d => bb.sum(d.n), r: d => bb.round(d.value, 2), id: d => bb.pad(d.quantity, 3, 0), due: d => bb.date("2021-02-27", 3) } 7∆3.14159+1+2`, `[{"due":"2021-03-02","id":"007","n":[1,2],"quantity":7,"r":3.14,"total":3,"value":3.14159}]`},
 	// TODO: broken
 	//{"modifiers", "a = { t: a, *: b, !: c }\na* a*2 2a** a*! a!!`yes`!`no`", ``},  // TODO: not working properly
+	{"empty comment", "/**/1 /* 2 */ 3", `[1,3]`},
 	{"dash modifier", `a = { -: b } -1a-2-3`, `[{"b":3,"quantity":-1,"value":-2}]`}, // TODO: not sure if this is what we want to happen - disable negative numbers when '-' is a modifier
 
 	//TODO: future features
@@ -38,11 +62,12 @@ var testCases = []testCase{
 
 func Test_Parse_simple(t *testing.T) {
 
-	verbose = true
+	p := NewParser()
+	p.Logger = NewTextLogger(ioutil.Discard) // make sure logging doesn't change anything
 
 	for i := range testCases {
 
-		data := Parse(testCases[i].raw)
+		data, _ := p.Parse(testCases[i].raw)
 		result, err := json.Marshal(data)
 
 		if err != nil {
@@ -57,3 +82,792 @@ func Test_Parse_simple(t *testing.T) {
 
 	}
 }
+
+func Test_Parser_logger(t *testing.T) {
+
+	var trace bytes.Buffer
+	p := NewParser()
+	p.Logger = NewJSONLogger(&trace)
+	p.Parse("∆ = { +: f }\n2∆+")
+
+	lexed := false
+	decoder := json.NewDecoder(&trace)
+	for decoder.More() {
+		var entry LogEntry
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatalf("Trace isn't valid JSON: %s", err)
+		}
+		if entry.Message == "lexUDT" {
+			lexed = true
+			if entry.Line != 2 || entry.Offset != 15 {
+				t.Errorf("Expected lexUDT at line 2, offset 15, found line %d, offset %d", entry.Line, entry.Offset)
+			}
+		}
+	}
+	if !lexed {
+		t.Errorf("Expected the trace to include lexUDT")
+	}
+}
+
+func Test_ParseWithErrors(t *testing.T) {
+
+	data, errs := ParseWithErrors("1 2\n  \"foo")
+
+	if result, _ := json.Marshal(data); string(result) != `[1,2]` {
+		t.Fatalf(`Not the expected output: %s`, result)
+	}
+
+	if len(errs) != 1 {
+		t.Fatalf(`Expected 1 error, found %d: %v`, len(errs), errs)
+	}
+
+	if e := errs[0]; e.Line != 2 || e.Column != 3 || e.Offset != 6 || e.Text != "\"foo" || e.Message != "unterminated quoted string" {
+		t.Fatalf(`Not the expected error: %+v`, *e)
+	}
+}
+
+func Test_ParseWithErrors_recovery(t *testing.T) {
+
+	data, errs := ParseWithErrors("a = {:b, c: d}\n\"foo\nx = 5\na 1")
+
+	if result, _ := json.Marshal(data); string(result) != `[{"c":"d"},1]` {
+		t.Fatalf(`Not the expected output: %s`, result)
+	}
+
+	expected := []string{
+		"1:6: Prop name cannot be empty",
+		"2:1: unterminated quoted string",
+		"3:1: Invalid assignment, expected '{'",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf(`Expected %d errors, found %d: %v`, len(expected), len(errs), errs)
+	}
+
+	for i := range expected {
+		if errs[i].Error() != expected[i] {
+			t.Fatalf(`Not the expected error: %s vs %s`, errs[i], expected[i])
+		}
+	}
+}
+
+func Test_Parser(t *testing.T) {
+
+	p := NewParser()
+	if errs := p.Define("// import currency\n∆ = { type: triangle, +: f }\n□ = { s: big }"); len(errs) > 0 {
+		t.Fatalf(`Unexpected errors in definitions: %v`, errs)
+	}
+
+	inputs := []testCase{
+		{"defined types", "∆+ 2∆ $5", `[{"f":true,"type":"triangle"},{"quantity":2,"type":"triangle"},{"type":"money","unit":"United States dollar","value":5}]`},
+		{"types defined in input", "a = {} a ∆", `[{},{"type":"triangle"}]`},
+		{"inputs are independent", "a ∆", `["a",{"type":"triangle"}]`},
+		{"modifiers hide props", "□ □s □", `[{"s":"big"},{"big":true},{}]`},
+		{"hidden props are independent", "□", `[{"s":"big"}]`},
+	}
+
+	for _, c := range inputs {
+		data, errs := p.Parse(c.raw)
+		if len(errs) > 0 {
+			t.Fatalf(`Failed test case '%s': unexpected errors: %v`, c.name, errs)
+		}
+		if result, _ := json.Marshal(data); string(result) != c.parsed {
+			t.Fatalf(`Failed test case '%s': %s vs %s`, c.name, result, c.parsed)
+		}
+	}
+}
+
+func Test_Parser_strict(t *testing.T) {
+
+	input := "∆ = { f: d => d.x.y, g: d => ) }\n1 ∆"
+	expected := `[1,{"f":null,"g":null}]`
+
+	p := NewParser()
+	data, errs := p.Parse(input)
+	if result, _ := json.Marshal(data); string(result) != expected || len(errs) > 0 {
+		t.Fatalf(`Expected %s and no errors in lenient mode, found %s and %v`, expected, result, errs)
+	}
+
+	p.Strict = true
+	data, errs = p.Parse(input)
+	if result, _ := json.Marshal(data); string(result) != expected {
+		t.Fatalf(`Expected %s in strict mode, found %s`, expected, result)
+	}
+	if len(errs) != 2 {
+		t.Fatalf(`Expected 2 errors, found %v`, errs)
+	}
+	var scriptErr *ScriptError
+	if !errors.As(errs[0], &scriptErr) || scriptErr.Unit != "∆" || scriptErr.Prop != "f" ||
+		!strings.HasPrefix(scriptErr.Message, "TypeError") {
+		t.Errorf(`Expected a TypeError from prop f of ∆, found %v`, errs[0])
+	}
+	if errs[0].Line != 2 || errs[0].Column != 3 || errs[1].Err.(*ScriptError).Prop != "g" {
+		t.Errorf(`Unexpected errors: %v, %v`, errs[0], errs[1])
+	}
+}
+
+func Test_Parser_scriptLimits(t *testing.T) {
+
+	p := NewParser()
+	p.Strict = true
+	p.ScriptTimeout = 50 * time.Millisecond
+	p.MaxScriptOutput = 10
+
+	cases := []struct {
+		name    string
+		raw     string
+		parsed  string
+		message string
+	}{
+		{"timeout", "∆ = { f: d => (function(){ while(true){} })() } ∆", `[{"f":null}]`, "script took longer than 50ms"},
+		{"max output", "∆ = { f: d => 'more than ten bytes' } ∆", `[{"f":null}]`, "result is larger than 10 bytes"},
+		{"within limits", "∆ = { f: d => 'ok' } ∆", `[{"f":"ok"}]`, ""},
+	}
+
+	for _, c := range cases {
+		data, errs := p.Parse(c.raw)
+		if result, _ := json.Marshal(data); string(result) != c.parsed {
+			t.Errorf(`Failed test case '%s': %s vs %s`, c.name, result, c.parsed)
+		}
+		if c.message == "" && len(errs) > 0 {
+			t.Errorf(`Failed test case '%s': unexpected errors: %v`, c.name, errs)
+		} else if c.message != "" && (len(errs) != 1 || errs[0].Err.(*ScriptError).Message != c.message) {
+			t.Errorf(`Failed test case '%s': expected '%s', found %v`, c.name, c.message, errs)
+		}
+	}
+
+	p.NoScripts = true
+	data, errs := p.Parse("∆ = { f: d => d.value } ∆1")
+	if result, _ := json.Marshal(data); string(result) != `[{"f":"d =\u003e d.value","value":1}]` {
+		t.Errorf(`Expected the script to be kept as a string, found %s`, result)
+	}
+	if len(errs) != 1 || errs[0].Err.(*ScriptError).Message != "scripts are disabled" {
+		t.Errorf(`Expected an error for the disabled script, found %v`, errs)
+	}
+}
+
+func Test_Parser_transform(t *testing.T) {
+
+	p := NewParser()
+	p.Strict = true
+
+	data, errs := p.Parse("// transform items => items.filter(x => x !== 2)\n1 2 3\n// transform items => items.map((x, i) => ({ i, x }))")
+	if result, _ := json.Marshal(data); string(result) != `[{"i":0,"x":1},{"i":1,"x":3}]` {
+		t.Errorf(`Expected the transforms to be run in order, found %s`, result)
+	}
+	if len(errs) > 0 {
+		t.Errorf(`Unexpected errors: %v`, errs)
+	}
+
+	data, errs = p.Parse("1 2\n// transform items => items.length")
+	if result, _ := json.Marshal(data); string(result) != `[1,2]` {
+		t.Errorf(`Expected the output to be kept when the transform fails, found %s`, result)
+	}
+	if len(errs) != 1 || errs[0].Line != 2 || errs[0].Message != "transform failed: transform must return an array" {
+		t.Errorf(`Expected an error for the transform, found %v`, errs)
+	}
+
+	data, errs = p.Parse("// transform the list below\n1 2")
+	if result, _ := json.Marshal(data); string(result) != `[1,2]` || len(errs) > 0 {
+		t.Errorf(`Expected a comment that isn't a function to be ignored, found %s, %v`, result, errs)
+	}
+}
+
+func Test_Parser_source(t *testing.T) {
+
+	input := "∆ = { at: (d, src) => `${src.line}:${src.column}` }\n1∆ 2∆\n  ∆`x`"
+	expected := `[` +
+		`{"_source":{"column":1,"line":2,"offset":54,"text":"1∆"},"at":"2:1","quantity":1},` +
+		`{"_source":{"column":4,"line":2,"offset":59,"text":"2∆"},"at":"2:4","quantity":2},` +
+		`{"_source":{"column":3,"line":3,"offset":66,"text":"∆` + "`x`" + `"},"at":"3:3","value":"x"}]`
+
+	p := NewParser()
+	p.Source = true
+	data, _ := p.Parse(input)
+	if result, _ := json.Marshal(data); string(result) != expected {
+		t.Errorf(`Expected the source of each UDT, found %s`, result)
+	}
+
+	// offsets are from the start of the stream rather than the statement
+	d := p.NewDecoder(strings.NewReader(input))
+	data = data[:0]
+	for d.More() {
+		if value, err := d.Next(); err == nil {
+			data = append(data, value)
+		}
+	}
+	if result, _ := json.Marshal(data); string(result) != expected {
+		t.Errorf(`Expected the decoder to find the same source, found %s`, result)
+	}
+}
+
+func Test_Parser_scriptIsolation(t *testing.T) {
+
+	p := NewParser()
+	if err := p.RegisterFunc("double", func(x float64) float64 { return x * 2 }); err != nil {
+		t.Fatalf(`Unexpected error: %v`, err)
+	}
+	p.Define("∆ = { max: d => Math.max(1, 2), double: d => double(d.value), bb: d => bb.sum([1, 2]) }")
+
+	// scripts in one document can change the globals for the rest of it
+	p.Parse("x = { f: d => { Math.max = () => 42; double = null; bb = null; return 1 } }\nx")
+
+	data, _ := p.Parse("∆3")
+	if result, _ := json.Marshal(data); string(result) != `[{"bb":3,"double":6,"max":2,"value":3}]` {
+		t.Errorf(`Expected globals to be reset for each document, found %s`, result)
+	}
+
+	// but not bb
+	data, _ = p.Parse("x = { f: d => { bb = null; delete globalThis.bb; return 1 } }\ny = { g: d => bb.sum([1, 2]) }\nx y")
+	if result, _ := json.Marshal(data); string(result) != `[{"f":1},{"g":3}]` {
+		t.Errorf(`Expected bb to be kept in the document, found %s`, result)
+	}
+}
+
+func Test_ParseUDT(t *testing.T) {
+
+	tri := NewUDTFromDefinition("∆", map[string]string{"type": "triangle", "area": "d => d.value / 2"})
+	value := ParseUDT(&UDTInstance{Unit: "∆", Value: &Number{Value: 3}}, tri)
+	if result, _ := json.Marshal(value); string(result) != `{"area":1.5,"type":"triangle","value":3}` {
+		t.Errorf(`Not the expected value: %s`, result)
+	}
+}
+
+func Test_RunScript(t *testing.T) {
+
+	for _, script := range []string{"function f(d) { return d * 2 }", "var f = d => d * 2", "d => d * 2"} {
+		if value := RunScript(script, 3); value != 6.0 {
+			t.Errorf(`Not the expected result of '%s': %v`, script, value)
+		}
+	}
+	if value := RunScript("function f(d) { throw 'oops' }", 3); value != nil {
+		t.Errorf(`Expected nil for a script that throws, found %v`, value)
+	}
+
+	if _, err := RunScriptWithErrors("d => { throw 'oops' }", 3, nil); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf(`Not the expected error: %v`, err)
+	}
+}
+
+func Test_Parser_RegisterFunc(t *testing.T) {
+
+	p := NewParser()
+	p.Strict = true
+
+	data, _ := p.Parse("∆ = { double: d => double(d.value) }\n∆2")
+	if result, _ := json.Marshal(data); string(result) != `[{"double":null,"value":2}]` {
+		t.Errorf(`Expected null before the function is registered, found %s`, result)
+	}
+
+	if err := p.RegisterFunc("double", func(x float64) float64 { return x * 2 }); err != nil {
+		t.Errorf(`Unexpected error: %v`, err)
+	}
+	if err := p.RegisterFunc("price", func(sku string) (float64, error) {
+		if sku == "apple" {
+			return 0.5, nil
+		}
+		return 0, errors.New("unknown product " + sku)
+	}); err != nil {
+		t.Errorf(`Unexpected error: %v`, err)
+	}
+
+	data, errs := p.Parse("∆ = { double: d => double(d.value), price: d => price(d.value) }\n∆2 ∆`apple` ∆`pear`")
+	if result, _ := json.Marshal(data); string(result) != `[{"double":4,"price":null,"value":2},{"double":null,"price":0.5,"value":"apple"},{"double":null,"price":null,"value":"pear"}]` {
+		t.Errorf(`Expected the functions to be called, found %s`, result)
+	}
+	if len(errs) != 2 || !strings.Contains(errs[1].Error(), "unknown product pear") {
+		t.Errorf(`Expected the error from the function to be thrown, found %v`, errs)
+	}
+
+	if err := p.RegisterFunc("not a name", func() {}); err == nil {
+		t.Errorf(`Expected an error for an invalid name`)
+	}
+	if err := p.RegisterFunc("x", 1); err == nil {
+		t.Errorf(`Expected an error for a value that isn't a function`)
+	}
+	if err := p.RegisterFunc("bb", func() {}); err == nil {
+		t.Errorf(`Expected an error for the name of the helpers`)
+	}
+}
+
+func Test_RegisterDecoder(t *testing.T) {
+
+	RegisterDecoder("words", DecoderFunc(func(value string) (interface{}, error) {
+		if value == "" {
+			return nil, errors.New("no words")
+		}
+		return strings.Fields(value), nil
+	}))
+
+	p := NewParser()
+	p.Strict = true
+	data, errs := p.Parse("words`a b c` words5 words`` json`{`")
+	if result, _ := json.Marshal(data); string(result) != `[["a","b","c"],5,{"type":"error","unit":"words","value":"","error":"no words"},{"type":"error","unit":"json","value":"{","error":"unexpected end of JSON input"}]` {
+		t.Errorf(`Expected the values to be decoded, found %s`, result)
+	}
+	if len(errs) != 2 || errs[0].Message != "couldn't decode words value: no words" || errs[1].Column != 29 {
+		t.Errorf(`Expected errors for the values that couldn't be decoded, found %v`, errs)
+	}
+}
+
+func Test_Parser_importFile(t *testing.T) {
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"types/inventory.bb": "// import ../shared.bb\nbox = { type: box }",
+		"shared.bb":          "crate = { type: crate }",
+		"a.bb":               "// import ./b.bb",
+		"b.bb":               "// import ./a.bb",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := NewParser()
+	p.Dir = dir
+	data, errs := p.Parse("// import ./types/inventory.bb\n// import shared.bb\n3box 2crate")
+	if result, _ := json.Marshal(data); string(result) != `[{"quantity":3,"type":"box"},{"quantity":2,"type":"crate"}]` {
+		t.Errorf(`Expected the imported types, found %s`, result)
+	}
+	if len(errs) > 0 {
+		t.Errorf(`Unexpected errors: %v`, errs)
+	}
+
+	for input, message := range map[string]string{
+		"// import ./a.bb":       "import cycle",
+		"// import ./missing.bb": "couldn't import './missing.bb'",
+		"// import nope":         "unknown collection 'nope'",
+		"// import si only zz":   "'zz' isn't in si",
+		"// import ./a.bb as a.": "can only be used with collections",
+	} {
+		if _, errs := p.Parse(input); len(errs) != 1 || !strings.Contains(errs[0].Message, message) {
+			t.Errorf(`Expected an error for '%s', found %v`, input, errs)
+		}
+	}
+
+	// files outside Dir, including those imported by imported files, can't be imported when imports are restricted
+	restricted := NewParser()
+	restricted.Dir = filepath.Join(dir, "types")
+	restricted.RestrictImports = true
+	for _, input := range []string{"// import ../shared.bb", "// import " + filepath.Join(dir, "shared.bb"), "// import ./inventory.bb"} {
+		if _, errs := restricted.Parse(input); len(errs) != 1 || !strings.Contains(errs[0].Message, "isn't in the import directory") {
+			t.Errorf(`Expected an error for '%s', found %v`, input, errs)
+		}
+	}
+	restricted.Dir = dir
+	if _, errs := restricted.Parse("// import ./types/inventory.bb"); len(errs) > 0 {
+		t.Errorf(`Unexpected errors: %v`, errs)
+	}
+
+	disabled := NewParser()
+	disabled.Dir = dir
+	disabled.NoFileImports = true
+	if _, errs := disabled.Parse("// import ./shared.bb"); len(errs) != 1 || !strings.Contains(errs[0].Message, "importing files is disabled") {
+		t.Errorf(`Expected an error for a file import, found %v`, errs)
+	}
+	if _, errs := disabled.Parse("// import si"); len(errs) > 0 {
+		t.Errorf(`Unexpected errors: %v`, errs)
+	}
+}
+
+func Test_RegisterCollection(t *testing.T) {
+
+	RegisterCollection("Lab", Collection{
+		"flask":  {"type": "glassware", "ml": "250"},
+		"beaker": {"type": "glassware", "litres": "d => d.quantity / 1000"},
+	})
+
+	data, errs := ParseWithErrors("// import lab as lab.\n2lab.flask 500lab.beaker")
+	if result, _ := json.Marshal(data); string(result) != `[{"ml":250,"quantity":2,"type":"glassware"},{"litres":0.5,"quantity":500,"type":"glassware"}]` {
+		t.Errorf(`Expected the types in the collection, found %s`, result)
+	}
+	if len(errs) > 0 {
+		t.Errorf(`Unexpected errors: %v`, errs)
+	}
+}
+
+func Test_Parser_DefineJSON(t *testing.T) {
+
+	p := NewParser()
+	if err := p.DefineJSON([]byte(`{"∆": {"type": "triangle", "sides": 3, "id": "42", "half": "d => d.value / 2"}}`)); err != nil {
+		t.Fatalf(`Unexpected error: %v`, err)
+	}
+	if err := p.DefineYAML([]byte("□:\n  sides: 4\n  +: big\n")); err != nil {
+		t.Fatalf(`Unexpected error: %v`, err)
+	}
+
+	data, _ := p.Parse("∆4 □+")
+	if result, _ := json.Marshal(data); string(result) != `[{"half":2,"id":"42","sides":3,"type":"triangle","value":4},{"big":true,"sides":4}]` {
+		t.Errorf(`Expected the defined types, found %s`, result)
+	}
+
+	if err := p.DefineJSON([]byte(`{"a": {"b": 1}, "c": {"d": [1]}}`)); err == nil || err.Error() != "invalid definition of 'c': prop 'd' must be a number or a string" {
+		t.Errorf(`Expected an error for the invalid prop, found %v`, err)
+	}
+	if data, _ := p.Parse("a"); len(data) != 1 || data[0] != "a" {
+		t.Errorf(`Expected no types to be added from invalid definitions, found %v`, data)
+	}
+}
+
+func Test_Parser_Types(t *testing.T) {
+
+	p := NewParser()
+	p.Define("∆ = { sides: 3 }")
+	p.DefinitionsName = "shapes.bb"
+	p.Define("\n□ = { sides: 4 }")
+	p.DefinitionsName = "shapes.json"
+	p.DefineJSON([]byte(`{"⬠": {"sides": 5}}`))
+
+	types, errs := p.Types("// import si only W,Wb\nW = { +: f, g: d => 1 }\n∆ = { sides: 4 }", "doc.bb")
+	if len(errs) > 0 {
+		t.Fatalf(`Unexpected errors: %v`, errs)
+	}
+
+	found := map[string]TypeInfo{}
+	for _, info := range types {
+		if _, ok := found[info.Unit]; !ok {
+			found[info.Unit] = info // user defined types come first
+		}
+	}
+	if w := found["W"]; !w.UserDefined || w.Origin != "doc.bb:2" || strings.Join(w.Modifiers, " ") != "+ g" || strings.Join(w.Shadows, " ") != "W Wb" {
+		t.Errorf(`Not the expected type: %+v`, w)
+	}
+	if d := found["∆"]; d.Origin != "doc.bb:3" || d.Replaces != "definitions:1" || d.NumericalProps["sides"] != 4 {
+		t.Errorf(`Not the expected type: %+v`, d)
+	}
+	if found["□"].Origin != "shapes.bb:2" || found["⬠"].Origin != "shapes.json" {
+		t.Errorf(`Not the expected origins: %q, %q`, found["□"].Origin, found["⬠"].Origin)
+	}
+	if wb := found["Wb"]; wb.UserDefined || wb.Origin != "collection si" {
+		t.Errorf(`Not the expected type: %+v`, wb)
+	}
+}
+
+func Test_Decoder(t *testing.T) {
+
+	cases := append(testCases,
+		testCase{"multiline definition", "a = {\n  b: c, // comment\n  d: `x\ny`\n}\n1a /* multiline\ncomment */ 2a", `[{"b":"c","d":"x\ny","quantity":1},{"b":"c","d":"x\ny","quantity":2}]`},
+		testCase{"multiline value", "a = {}\n1 a`x\ny` 2", `[1,{"value":"x\ny"},2]`},
+	)
+
+	for _, c := range cases {
+		d := NewDecoder(strings.NewReader(c.raw))
+
+		data := make([]interface{}, 0)
+		for d.More() {
+			value, err := d.Next()
+			if err != nil {
+				t.Fatalf(`Failed test case '%s': unexpected error: %s`, c.name, err)
+			}
+			data = append(data, value)
+		}
+
+		if _, err := d.Next(); err != io.EOF {
+			t.Fatalf(`Failed test case '%s': expected EOF, found %v`, c.name, err)
+		}
+
+		if result, _ := json.Marshal(data); string(result) != c.parsed {
+			t.Fatalf(`Failed test case '%s': %s vs %s`, c.name, result, c.parsed)
+		}
+	}
+}
+
+func Test_Decoder_errors(t *testing.T) {
+
+	d := NewDecoder(strings.NewReader("1\n\"foo\n2"))
+
+	if value, err := d.Next(); value != 1.0 || err != nil {
+		t.Fatalf(`Not the expected value: %v, %v`, value, err)
+	}
+
+	if _, err := d.Next(); err == nil || err.Error() != "2:1: unterminated quoted string" || err.(*Error).Offset != 2 {
+		t.Fatalf(`Not the expected error: %v`, err)
+	}
+
+	if value, err := d.Next(); value != 2.0 || err != nil {
+		t.Fatalf(`Not the expected value: %v, %v`, value, err)
+	}
+}
+
+func Test_Decoder_streaming(t *testing.T) {
+
+	r, w := io.Pipe()
+	d := NewDecoder(r)
+
+	go w.Write([]byte("a = { b: c }\n1a\n"))
+
+	// the first value must be returned before the rest of the input has been written
+	if value, err := d.Next(); err != nil || value.(map[string]interface{})["b"] != "c" {
+		t.Fatalf(`Not the expected value: %v, %v`, value, err)
+	}
+
+	go func() {
+		w.Write([]byte("2a"))
+		w.Close()
+	}()
+
+	if value, err := d.Next(); err != nil || value.(map[string]interface{})["quantity"] != 2.0 {
+		t.Fatalf(`Not the expected value: %v, %v`, value, err)
+	}
+
+	if d.More() {
+		t.Fatalf(`Expected the end of the input`)
+	}
+}
+
+func Test_Decoder_unterminated(t *testing.T) {
+
+	defer func(size int) { maxStatementSize = size }(maxStatementSize)
+	maxStatementSize = 64
+
+	inputs := []struct {
+		name  string
+		raw   string
+		value bool // whether the value after the unterminated statement is found
+	}{
+		{"stray quote", "a \"b\n", true},
+		{"long raw string", "`" + strings.Repeat("x\n", 100) + "`\n", true},
+		{"long line", strings.Repeat("x ", 5000) + "\n", true},
+		{"unterminated raw string", "`" + strings.Repeat("x\n", 100), false},
+		{"unterminated comment", "/*" + strings.Repeat("x\n", 100), false},
+	}
+
+	for _, c := range inputs {
+		r, w := io.Pipe()
+		d := NewDecoder(r)
+		go w.Write([]byte(c.raw + "5\n"))
+
+		// the value after the statement, or the error if the statement is too long, must be found before the
+		// writer is closed
+		found := make(chan interface{})
+		go func() {
+			for d.More() {
+				value, err := d.Next()
+				if err != nil {
+					found <- err
+				} else {
+					found <- value
+				}
+			}
+			close(found)
+		}()
+
+		var values []interface{}
+		var errs []error
+	Loop:
+		for {
+			select {
+			case next, ok := <-found:
+				if !ok {
+					break Loop
+				}
+				if err, isErr := next.(error); isErr {
+					errs = append(errs, err)
+				} else {
+					values = append(values, next)
+				}
+				if c.value && next == 5.0 || !c.value && len(errs) > 0 {
+					w.Close()
+				}
+			case <-time.After(time.Second):
+				t.Fatalf(`Failed test case '%s': nothing was found before the end of the input`, c.name)
+			}
+		}
+
+		if c.value {
+			if len(values) == 0 || values[len(values)-1] != 5.0 {
+				t.Errorf(`Failed test case '%s': expected the value after the statement, found %v`, c.name, values)
+			}
+		} else if len(values) > 0 {
+			t.Errorf(`Failed test case '%s': expected the statement to be skipped, found %v`, c.name, values)
+		}
+		if c.name != "stray quote" && (len(errs) != 1 || errs[0].Error() != "1:1: statement is longer than 64 bytes") {
+			t.Errorf(`Failed test case '%s': expected an error for the long statement, found %v`, c.name, errs)
+		}
+	}
+}
+
+func Test_Parser_table(t *testing.T) {
+
+	p := NewParser()
+	p.Table = true
+
+	inputs := []testCase{
+		{"tabs", "name\tqty\napple pie\t3\n\n", `[["name","qty"],["apple pie",3]]`},
+		{"spaces", "a = {}\nx  1 2   3a", `[["x",[1,2],{"quantity":3}]]`},
+		{"empty cells", "\t1\t\t2\t\n", `[[null,1,null,2,null]]`},
+	}
+
+	for _, c := range inputs {
+		data, errs := p.Parse(c.raw)
+		if len(errs) > 0 {
+			t.Fatalf(`Failed test case '%s': unexpected errors: %v`, c.name, errs)
+		}
+		if result, _ := json.Marshal(data); string(result) != c.parsed {
+			t.Fatalf(`Failed test case '%s': %s vs %s`, c.name, result, c.parsed)
+		}
+	}
+}
+
+func Test_ParseAST(t *testing.T) {
+
+	input := "∆ = { t: x, +: f } // comment\n2∆\"a\"+3 foo 1.5 true null"
+	doc, errs := ParseAST(input)
+	if len(errs) > 0 {
+		t.Fatalf(`Unexpected errors: %v`, errs)
+	}
+
+	if len(doc.Nodes) != 6 || len(doc.Comments) != 1 {
+		t.Fatalf(`Expected 6 nodes and 1 comment, found %d and %d`, len(doc.Nodes), len(doc.Comments))
+	}
+
+	definition := doc.Nodes[0].(*Definition)
+	if definition.Unit != "∆" || len(definition.Props) != 2 || input[definition.Pos():definition.End()] != "∆ = { t: x, +: f }" {
+		t.Fatalf(`Not the expected definition: %+v`, definition)
+	}
+	if prop := definition.Props[1]; prop.Name != "+" || prop.Value != "f" || input[prop.Pos():prop.End()] != "+: f" {
+		t.Fatalf(`Not the expected prop: %+v`, prop)
+	}
+
+	instance := doc.Nodes[1].(*UDTInstance)
+	if instance.Quantity.(*Number).Value != 2 || instance.Unit != "∆" || instance.Value.(*String).Value != "a" {
+		t.Fatalf(`Not the expected UDT instance: %+v`, instance)
+	}
+	if m := instance.Modifiers[0]; m.Name != "+" || m.Value.(*Number).Value != 3 || input[m.Pos():m.End()] != "+3" {
+		t.Fatalf(`Not the expected modifier: %+v`, m)
+	}
+	if line, column := doc.Position(instance.Pos()); line != 2 || column != 1 {
+		t.Fatalf(`Not the expected position: %d:%d`, line, column)
+	}
+
+	if s := doc.Nodes[2].(*String); s.Value != "foo" || input[s.Pos():s.End()] != "foo" {
+		t.Fatalf(`Not the expected string: %+v`, s)
+	}
+
+	count := 0
+	Inspect(doc, func(n Node) bool {
+		count++
+		return true
+	})
+	if count != 14 {
+		t.Fatalf(`Expected to inspect 14 nodes, found %d`, count)
+	}
+}
+
+// a large input with many UDT instances, for benchmarks
+var benchmarkInput = func() string {
+	var b strings.Builder
+	b.WriteString("// import si\n∆ = { type: triangle, +: plus, #: tag, ~: approx }\nm = { type: message }\n")
+	for i := 0; i < 2000; i++ {
+		b.WriteString("3∆5+2#\"foo\" ∆\"bar\"~ 12.5kg m:hello 1.5∆+1+2 word 42 ")
+		b.WriteString("md`" + strings.Repeat("lorem ipsum ", 20) + "`\n")
+	}
+	return b.String()
+}()
+
+func Benchmark_Parse(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Parse(benchmarkInput)
+	}
+}
+
+func Benchmark_Lex(b *testing.B) {
+	p := NewParser()
+	for i := 0; i < b.N; i++ {
+		lexAll(p, benchmarkInput)
+	}
+}
+
+// Benchmark_LexChannel runs the same state machine in a goroutine that sends each item over an unbuffered
+// channel, which is how the lexer used to work, for comparison with Benchmark_Lex.
+func Benchmark_LexChannel(b *testing.B) {
+	p := NewParser()
+	for i := 0; i < b.N; i++ {
+		lexAllChannel(p, benchmarkInput)
+	}
+}
+
+// smallBenchmarkInputs are many short snippets, like a batch job that parses one field of each record, where
+// the cost of starting to lex matters more than the cost of each item.
+var smallBenchmarkInputs = func() []string {
+	snippets := []string{"3∆5+2", "12.5kg", "m:hello", "word 42", "md`lorem ipsum`", "∆\"bar\"~"}
+	inputs := make([]string, 1000)
+	for i := range inputs {
+		inputs[i] = snippets[i%len(snippets)]
+	}
+	return inputs
+}()
+
+func Benchmark_Lex_small(b *testing.B) {
+	p := NewParser()
+	for i := 0; i < b.N; i++ {
+		for _, input := range smallBenchmarkInputs {
+			lexAll(p, input)
+		}
+	}
+}
+
+func Benchmark_LexChannel_small(b *testing.B) {
+	p := NewParser()
+	for i := 0; i < b.N; i++ {
+		for _, input := range smallBenchmarkInputs {
+			lexAllChannel(p, input)
+		}
+	}
+}
+
+func Benchmark_Parse_small(b *testing.B) {
+	p := NewParser()
+	p.Define("∆ = { type: triangle, +: plus, #: tag, ~: approx }\nm = { type: message }")
+	for i := 0; i < b.N; i++ {
+		for _, input := range smallBenchmarkInputs {
+			p.Parse(input)
+		}
+	}
+}
+
+// lexAll lexes the input with the pre-defined types of p, like Parse does.
+func lexAll(p *Parser, input string) {
+	l := lex(input, p.registry.clone(), p)
+	for _, ok := l.nextItem(); ok; _, ok = l.nextItem() {
+	}
+}
+
+func lexAllChannel(p *Parser, input string) {
+	l := lex(input, p.registry.clone(), p)
+	items := make(chan item)
+	go func() {
+		for state := lexBb; state != nil; {
+			state = state(l)
+			for _, item := range l.items {
+				items <- item
+			}
+			l.items = l.items[:0]
+		}
+		close(items)
+	}()
+	for range items {
+	}
+}
+
+var scriptBenchmarkInput = "∆ = { area: d => d.quantity * d.value / 2, label: d => 'triangle ' + d.quantity }\n" +
+	strings.Repeat("3∆4 ", 2000)
+
+func Benchmark_Parse_scripts(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Parse(scriptBenchmarkInput)
+	}
+}
+
+func Benchmark_Parse_import(b *testing.B) {
+	p := NewParser()
+	for i := 0; i < b.N; i++ {
+		p.Parse("// import si\n3kg")
+	}
+}
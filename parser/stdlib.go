@@ -0,0 +1,50 @@
+package parser
+
+import "github.com/dop251/goja"
+
+// stdlib defines the bb object, with helpers for common things that script props do. The object is frozen, and the
+// global can't be reassigned or deleted, so that a script can't break it for the scripts that run after it in the
+// same VM.
+const stdlib = `
+Object.defineProperty(globalThis, "bb", { writable: false, configurable: false, value: Object.freeze({
+	// list converts a modifier value to an array - modifiers are only arrays if they're repeated
+	list: function(x) {
+		if (x === undefined || x === null) return [];
+		return Array.isArray(x) ? x : [x];
+	},
+
+	// sum adds up the numbers in a modifier value, ignoring anything that isn't a number
+	sum: function(x) {
+		return bb.list(x).reduce(function(total, v) { return typeof v === "number" ? total + v : total; }, 0);
+	},
+
+	// round rounds a number to a number of decimal places, 0 by default
+	round: function(x, places) {
+		var scale = Math.pow(10, places || 0);
+		return Math.round(x * scale) / scale;
+	},
+
+	// pad pads the start of a value to a width, or the end if the width is negative, with spaces by default
+	pad: function(x, width, fill) {
+		var s = String(x === undefined || x === null ? "" : x);
+		fill = fill === undefined ? " " : String(fill);
+		return width < 0 ? s.padEnd(-width, fill) : s.padStart(width, fill);
+	},
+
+	// date converts a date, e.g. "2021-03-04" or a timestamp in milliseconds, to a "YYYY-MM-DD" string in UTC,
+	// after adding a number of days. It's null if the date isn't valid.
+	date: function(x, days) {
+		var d = new Date(x);
+		if (isNaN(d.getTime())) return null;
+		d.setUTCDate(d.getUTCDate() + (days || 0));
+		return d.toISOString().slice(0, 10);
+	},
+
+	// days returns the number of whole days from one date to another
+	days: function(from, to) {
+		return Math.round((new Date(to).getTime() - new Date(from).getTime()) / 86400000);
+	}
+}) });
+`
+
+var stdlibProgram = goja.MustCompile("bb", stdlib, false)
@@ -0,0 +1,88 @@
+package parser
+
+import "strings"
+
+// table builds rows of values from items in table mode. Each line is a row, and tabs or runs of two or more
+// spaces separate the columns, so that bb pasted from a spreadsheet keeps its shape.
+type table struct {
+	rows  []interface{}
+	row   []interface{} // cells in the current row
+	cell  []interface{} // values in the current cell
+	empty bool          // true if nothing has been found on the current line
+}
+
+func newTable() *table {
+	return &table{rows: make([]interface{}, 0), empty: true}
+}
+
+// add adds an item to the table. Items that aren't values or separators are ignored.
+// The errors are from converting the item to a value - see lexer.value.
+func (t *table) add(l *lexer, item item) []error {
+	switch item.typ {
+	case itemTab:
+		t.separate(item.val)
+	case itemNewline:
+		// tabs at the end of the line are empty cells, but spaces are ignored
+		t.separate(strings.Trim(item.val[:strings.Index(item.val, "\n")], " "))
+		t.endRow()
+	default:
+		value, ok, errs := l.value(item)
+		if ok {
+			t.cell = append(t.cell, value)
+			t.empty = false
+		}
+		return errs
+	}
+	return nil
+}
+
+// separate ends the current cell. Every tab in the whitespace starts a new column, so consecutive tabs
+// create empty cells. Spaces on their own only count as a separator if there are two or more.
+func (t *table) separate(whitespace string) {
+	columns := strings.Count(whitespace, "\t")
+	if columns == 0 && len(whitespace) > 1 {
+		columns = 1
+	}
+	for i := 0; i < columns; i++ {
+		t.row = append(t.row, cellValue(t.cell))
+		t.cell = nil
+		t.empty = false
+	}
+}
+
+// endRow ends the current row. Lines without any values or separators, e.g. definitions, aren't rows.
+func (t *table) endRow() {
+	if !t.empty {
+		t.row = append(t.row, cellValue(t.cell))
+		t.rows = append(t.rows, t.row)
+	}
+	t.row = nil
+	t.cell = nil
+	t.empty = true
+}
+
+// finish ends the last row and returns all the rows.
+func (t *table) finish() []interface{} {
+	t.endRow()
+	return t.rows
+}
+
+// cellValue returns the value of a cell. Text separated by single spaces stays together as one string, and a cell
+// with several values of other types is a list.
+func cellValue(values []interface{}) interface{} {
+	switch len(values) {
+	case 0:
+		return nil
+	case 1:
+		return values[0]
+	}
+	words := make([]string, len(values))
+	for i, value := range values {
+		word, ok := value.(string)
+		if !ok {
+			return values
+		}
+		words[i] = word
+	}
+	return strings.Join(words, " ")
+}
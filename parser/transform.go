@@ -0,0 +1,48 @@
+package parser
+
+import "errors"
+
+// transform is a script that is run on the whole output once the document has been parsed, defined by a comment
+// like '// transform items => items.filter(x => x !== null)'. Its result replaces the output.
+type transform struct {
+	script *script
+	where  Error // the position of the comment that defined the transform, for reporting errors
+}
+
+// defineTransform adds a transform to the registry. The comment that defines it is the item being scanned.
+func (l *lexer) defineTransform(source string) {
+	_, column := position(l.input, l.start)
+	l.transforms = append(l.transforms, &transform{
+		script: compileScript(source),
+		where:  Error{Line: l.startLine, Column: column, Offset: int(l.start), Text: l.input[l.start:l.pos]},
+	})
+}
+
+// transform runs each transform in the registry on the output of a document, in the order they were defined.
+// If a transform fails then the output is left as it was, and the error is reported in strict mode.
+func (p *Parser) transform(r *registry, scripts *runner, data []interface{}) ([]interface{}, ErrorList) {
+	var errs ErrorList
+	for _, t := range r.transforms {
+		var err error
+		if p.NoScripts {
+			err = errors.New("scripts are disabled")
+		} else {
+			var result interface{}
+			if result, err = scripts.run(t.script, data); err == nil {
+				if items, ok := result.([]interface{}); ok {
+					data = items
+				} else {
+					err = errors.New("transform must return an array")
+				}
+			}
+		}
+
+		if err != nil && p.Strict {
+			e := t.where
+			e.Err = &ScriptError{Prop: "transform", Message: err.Error()}
+			e.Message = e.Err.Error()
+			errs = append(errs, &e)
+		}
+	}
+	return data, errs
+}
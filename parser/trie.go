@@ -0,0 +1,57 @@
+package parser
+
+// trie is a prefix tree of units or modifiers, used to find the longest one at the start of some input without
+// checking every unit or modifier in turn.
+type trie struct {
+	children map[byte]*trie
+	word     bool // true if a unit or modifier ends here
+}
+
+func newTrie(words ...string) *trie {
+	t := &trie{}
+	for _, word := range words {
+		t.insert(word)
+	}
+	return t
+}
+
+func (t *trie) insert(word string) {
+	node := t
+	for i := 0; i < len(word); i++ {
+		next, ok := node.children[word[i]]
+		if !ok {
+			if node.children == nil {
+				node.children = map[byte]*trie{}
+			}
+			next = &trie{}
+			node.children[word[i]] = next
+		}
+		node = next
+	}
+	node.word = true
+}
+
+// longestPrefix returns the longest word in the trie that s starts with, or "" if there isn't one.
+func (t *trie) longestPrefix(s string) string {
+	longest := 0
+	node := t
+	for i := 0; i < len(s); i++ {
+		node = node.children[s[i]]
+		if node == nil {
+			break
+		}
+		if node.word {
+			longest = i + 1
+		}
+	}
+	return s[:longest]
+}
+
+// hasPrefix returns true if any word in the trie starts with prefix.
+func (t *trie) hasPrefix(prefix string) bool {
+	node := t
+	for i := 0; i < len(prefix) && node != nil; i++ {
+		node = node.children[prefix[i]]
+	}
+	return node != nil
+}
@@ -0,0 +1,85 @@
+package parser
+
+import (
+	"sort"
+	"strings"
+)
+
+// TypeInfo describes a type that is in effect after the definitions and imports in an input - see Parser.Types.
+type TypeInfo struct {
+	Unit           string             `json:"unit"`
+	UserDefined    bool               `json:"userDefined"` // user defined types take priority over pre-defined ones
+	Origin         string             `json:"origin"`      // e.g. "types.bb:3", "collection si", or "pre-defined"
+	NumericalProps map[string]float64 `json:"numericalProps"`
+	StringProps    map[string]string  `json:"stringProps"`
+	ScriptProps    map[string]string  `json:"scriptProps"`
+	Modifiers      []string           `json:"modifiers"`
+	// Replaces is the origin of a type with the same unit that this type replaced, e.g. an earlier definition.
+	Replaces string `json:"replaces,omitempty"`
+	// Shadows is the units of the pre-defined types that can't be used because this user defined type is found
+	// first - the ones with the same unit, or a unit that starts with it, e.g. 'Wb' is shadowed by 'W'.
+	Shadows []string `json:"shadows,omitempty"`
+}
+
+// Types returns every type that is in effect after the definitions and imports in the input, as well as those
+// defined with Define, sorted by unit - where units are equal, user defined types come first. name is used for the
+// origins of types defined in the input, e.g. its file name, or "" to just use line numbers.
+func (p *Parser) Types(input string, name string) ([]TypeInfo, ErrorList) {
+	l := lex(input, p.registry.clone(), p)
+	l.name = name
+
+	var errs ErrorList
+	for item, ok := l.nextItem(); ok; item, ok = l.nextItem() {
+		if item.typ == itemError {
+			errs = append(errs, newError(l.input, item))
+		}
+	}
+
+	types := make([]TypeInfo, 0, len(l.UDTs)+len(l.PDTs))
+	for _, t := range l.UDTs {
+		info := newTypeInfo(t, true)
+		for unit := range l.PDTs {
+			if strings.HasPrefix(unit, t.Unit) {
+				info.Shadows = append(info.Shadows, unit)
+			}
+		}
+		sort.Strings(info.Shadows)
+		types = append(types, info)
+	}
+	for _, t := range l.PDTs {
+		types = append(types, newTypeInfo(t, false))
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Unit == types[j].Unit {
+			return types[i].UserDefined
+		}
+		return types[i].Unit < types[j].Unit
+	})
+	return types, errs
+}
+
+// newTypeInfo describes a type. The props are copied, because the parser's types share them.
+func newTypeInfo(t *udt, userDefined bool) TypeInfo {
+	info := TypeInfo{
+		Unit:           t.Unit,
+		UserDefined:    userDefined,
+		Origin:         t.origin,
+		NumericalProps: make(map[string]float64, len(t.NumericalProps)),
+		StringProps:    make(map[string]string, len(t.StringProps)),
+		ScriptProps:    make(map[string]string, len(t.ScriptProps)),
+		Modifiers:      append([]string{}, t.getModifiers()...),
+		Replaces:       t.replaces,
+	}
+	for k, v := range t.NumericalProps {
+		info.NumericalProps[k] = v
+	}
+	for k, v := range t.StringProps {
+		info.StringProps[k] = v
+	}
+	for k, v := range t.ScriptProps {
+		info.ScriptProps[k] = v
+	}
+	sort.Strings(info.Modifiers)
+	return info
+}
@@ -1,8 +1,8 @@
 package parser
 
 import (
-	"encoding/json"
-	"gopkg.in/yaml.v2"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
@@ -10,26 +10,40 @@ import (
 
 // Type to represent the definition of a UDT. Built-in types are defined here.
 type udt struct {
-	isSpecial      bool // has special properties that affect parsing (for pre-defined types)
-	colonAllowed   bool // see lexer.colonAllowed
+	decoder        ValueDecoder // decodes the value into data, for pre-defined types like json - see RegisterDecoder
+	colonAllowed   bool         // see lexer.colonAllowed
 	Unit           string
 	NumericalProps map[string]float64
 	StringProps    map[string]string // props with string values - these are all automatically treated as modifiers
-	ScriptProps    map[string]string // props that have JavaScript functions as values
+	ScriptProps    map[string]string // props that have JavaScript functions as values, as they are written
 	HiddenProps    []string          // props that are used as modifiers will be hidden from the final value
 	QuoteModifiers bool              // if true, then this UDT is using " as a modifier, which affects parsing
-
+	modifiers      *trie             // string and script props, for finding modifiers when lexing
+	scripts        map[string]*script
+	origin         string // where the type was defined, e.g. "types.bb:3" or "collection si"
+	replaces       string // the origin of the type with the same unit that this one replaced, if any
 }
 
 func NewUDT(unit string, numericalProps map[string]float64, stringProps map[string]string,
 	scriptProps map[string]string, quoteModifiers bool) *udt {
-	return &udt{Unit: unit, NumericalProps: numericalProps, StringProps: stringProps, ScriptProps: scriptProps,
-		isSpecial: false, QuoteModifiers: quoteModifiers}
+	t := &udt{Unit: unit, NumericalProps: numericalProps, StringProps: stringProps, ScriptProps: scriptProps,
+		QuoteModifiers: quoteModifiers}
+	t.modifiers = newTrie(t.getModifiers()...)
+	t.scripts = make(map[string]*script, len(scriptProps))
+	for prop, source := range scriptProps {
+		t.scripts[prop] = compileScript(source)
+	}
+	return t
 }
 
 // NewUDTFromDefinition creates new UDT instances.
 func NewUDTFromDefinition(unit string, props map[string]string) *udt {
-	log("Define new UDT with unit " + unit)
+	return newUDTFromDefinition(unit, props, nil)
+}
+
+// newUDTFromDefinition creates a UDT like NewUDTFromDefinition, logging the props it finds to logger.
+func newUDTFromDefinition(unit string, props map[string]string, logger Logger) *udt {
+	log(logger, "Define new UDT with unit "+unit)
 
 	numericalProps := map[string]float64{}
 	stringProps := map[string]string{}
@@ -45,28 +59,19 @@ func NewUDTFromDefinition(unit string, props map[string]string) *udt {
 		propValue = strings.ReplaceAll(propValue, "\\,", ",") // unescape ,
 		propValue = strings.ReplaceAll(propValue, "\\}", "}") // unescape }
 
-		log("found prop '" + propName + "' with value '" + propValue + "'")
+		log(logger, "found prop '"+propName+"' with value '"+propValue+"'")
 		if strings.Contains(propName, "\"") {
 			quoteModifiers = true
 		}
 
 		if number, err := strconv.ParseFloat(propValue, 64); err == nil { // if value is valid number
-			log("numerical prop: " + propName)
+			log(logger, "numerical prop: "+propName)
 			numericalProps[propName] = number
-		} else if strings.Contains(propValue, "=>") { // if value is an arrow function - TODO: check for single left hand argument and don't match strings that contain => but aren't functions
-			log("script prop: " + propName + ", with value: " + propValue)
-			functionStart := strings.Index(propValue, "=>")
-			// we must re-write as a normal function because we can only run ES5 syntax
-			// TODO: check if function is written in a block
-			//if strings.Contains(p[1][functionStart+2:], "return") {
-			//  function =
-			//}
-			// TODO: check function arg is single word (user may have forgotten a comma, which will be hard to debug) - need useful error message
-			function := "function f(" + propValue[:functionStart] + "){ return " + propValue[functionStart+2:] + "};"
-			log(function)
-			scriptProps[propName] = function
+		} else if isFunction(propValue) {
+			log(logger, "script prop: "+propName+", with value: "+propValue)
+			scriptProps[propName] = propValue
 		} else {
-			log("string prop: " + propName)
+			log(logger, "string prop: "+propName)
 			stringProps[propName] = removeQuotes(propValue)
 		}
 	}
@@ -74,123 +79,53 @@ func NewUDTFromDefinition(unit string, props map[string]string) *udt {
 	return NewUDT(unit, numericalProps, stringProps, scriptProps, quoteModifiers)
 }
 
-// Parse a UDT string - we already know it's valid
-func (t *udt) Parse(s string, modifiers map[string][]string) map[string]interface{} {
-	log("parse " + s + " with unit " + t.Unit)
+// Parse a UDT instance - we already know it's valid, and the lexer has found its parts. Script props are run with
+// the limits of NewParser, and are nil if they fail.
+func (t *udt) Parse(instance *UDTInstance) map[string]interface{} {
+	data, _ := t.parse(instance, NewParser().newRunner(), nil)
+	return data
+}
 
-	pos := strings.Index(s, t.Unit)
+// parse converts a UDT instance like Parse, running scripts with the limits of the runner's parser, or keeping
+// them as strings if the parser doesn't allow scripts. If script props fail then their values are nil, and there
+// is a *ScriptError for each of them, sorted by prop name. Scripts are given the source of the instance as their
+// second argument - see lexer.source.
+func (t *udt) parse(instance *UDTInstance, scripts *runner, source map[string]interface{}) (map[string]interface{}, []error) {
+	p := scripts.p
+	logger := p.Logger
+	if logger != nil {
+		log(logger, "parse "+instance.Unit+" instance with unit "+t.Unit)
+	}
 
 	data := make(map[string]interface{})
 
-	quantity := s[0:pos]
-	if quantity != "" {
-		number, err := strconv.ParseFloat(quantity, 64)
-		if err != nil {
-			data["quantity"] = quantity // invalid quantities are kept as string, e.g. 1.0.0
-		} else {
-			data["quantity"] = number
-		}
+	switch quantity := instance.Quantity.(type) {
+	case *Number:
+		data["quantity"] = quantity.Value
+	case *String:
+		data["quantity"] = quantity.Value // invalid quantities are kept as string, e.g. 1.0.0
 	}
 
-	pos += len(t.Unit)
-
-	length := len(s)
-
-	// TODO (big refactor) Don't re-parse stuff - store all parsed values during lexing (in the UDT instance)
-	if pos != length { // if there is anything remaining
-		hasValue := false
-
-		if r := rune(s[pos]); isQuoteChar(r) || r == ':' {
-			log("UDT has value")
-			hasValue = true
-			// we already know that value is valid from lexing
-			if isQuoteChar(r) {
-				log("this is left: " + s[pos:])
-
-				valueIdx := pos + 1
-				pos = valueIdx
-				for {
-					if t.QuoteModifiers && len(s) == pos {
-						// if we get to the end it's because this is actually a quote modifier, which
-						// means there is no value for this udt
-						log("wait no, UDT has no value")
-						hasValue = false
-						break
-					} else if rune(s[pos]) == r {
-						// we found the end quote
-						break
-					} else if rune(s[pos]) == '\\' && rune(s[pos+1]) == r {
-						pos += 2 // escaped quotes
-					} else {
-						log("this is left: " + s[pos:])
-						pos++
-					}
-				}
-				if hasValue {
-					data["value"] = s[valueIdx:pos]
-					pos++
-				}
-				// TODO: we still want to remove the backslashes from escaped quotes
-			} else if r == ':' {
-				log("it's an unquoted value - this is left: " + s[pos:])
-
-				valueIdx := pos + 1
-				pos = valueIdx
-
-				for {
-					if pos == length { //|| rune(s[pos]) == ' ' || rune(s[pos]) == '\n' {
-						break // we found the end - unquoted value can end on space or new line
-					} else if rune(s[pos]) == '\\' && rune(s[pos+1]) == ' ' {
-						pos += 2 // escaped space (technically we do allow these)
-					} else {
-						log("this is left: " + s[pos:])
-						pos++
-					}
-				}
-				// TODO: we still want to remove the backslashes from escaped spaces
-				data["value"] = s[valueIdx:pos]
-				pos++
-			}
-		} else if isNumeric(r) {
-			valueIdx := pos
-			isDecimal := false
-			//pos = valueIdx
-			for {
-				if pos == length || !isNumeric(rune(s[pos])) {
-					break
-				} else if rune(s[pos]) == '-' {
-					if pos != valueIdx {
-						break // negative sign can only appear at the start
-					}
-					pos++
-				} else if rune(s[pos]) == '.' {
-					if isDecimal {
-						break // decimal point can only appear once
-					}
-					isDecimal = true
-					pos++
-				} else {
-					pos++
-				}
-			}
-
-			value := s[valueIdx:pos]
+	switch value := instance.Value.(type) {
+	case *Number:
+		data["value"] = value.Value
+	case *String:
+		data["value"] = value.Value // invalid numerical values are kept as string too, e.g. 1.0.0
+		// TODO: we still want to remove the backslashes from escaped quotes and spaces
+	}
 
-			if value == "-" || value == "." {
-				pos-- // invalid numerical value - not a value but a modifier instead
-			} else {
-				number, err := strconv.ParseFloat(value, 64)
-				if err != nil {
-					data["value"] = s[valueIdx:pos] // invalid values are kept as string, e.g. 1.0.0
-				} else {
-					data["value"] = number
-				}
-			}
+	// group the raw values of each modifier, keeping the order they're found in
+	var names []string
+	modifiers := map[string][]string{}
+	for _, m := range instance.Modifiers {
+		if _, ok := modifiers[m.Name]; !ok {
+			names = append(names, m.Name)
 		}
+		modifiers[m.Name] = append(modifiers[m.Name], rawValue(m.Value))
 	}
 
-	for modifier, rawValues := range modifiers {
-		t.addModifierToData(data, modifier, rawValues)
+	for _, modifier := range names {
+		t.addModifierToData(data, modifier, modifiers[modifier], logger)
 	}
 
 	for k, v := range t.NumericalProps {
@@ -198,38 +133,56 @@ func (t *udt) Parse(s string, modifiers map[string][]string) map[string]interfac
 	}
 
 	// hide certain props
-LoopStringProps:
 	for k, v := range t.StringProps {
-		for _, prop := range t.HiddenProps {
-			if prop == k {
-				continue LoopStringProps // skip props that should be hidden
-			}
+		if t.isHidden(k) {
+			continue // skip props that should be hidden
 		}
 		if isModifierChar(rune(k[0])) {
-			continue LoopStringProps // skip props that start with standard modifier chars
+			continue // skip props that start with standard modifier chars
 		}
 		data[k] = v
 	}
 
+	var errs []error
 	for k, v := range t.ScriptProps {
-		result := RunScript(v, data)
+		if p.NoScripts {
+			data[k] = v
+			errs = append(errs, &ScriptError{Unit: t.Unit, Prop: k, Message: "scripts are disabled"})
+			continue
+		}
+		result, err := scripts.run(t.scripts[k], data, source)
+		if err != nil {
+			errs = append(errs, &ScriptError{Unit: t.Unit, Prop: k, Message: err.Error()})
+		}
 		data[k] = result
 	}
+	if p.Source {
+		data["_source"] = source
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].(*ScriptError).Prop < errs[j].(*ScriptError).Prop
+	})
 
-	return data
+	return data, errs
 }
 
-func (t *udt) addModifierToData(data map[string]interface{}, modifier string, values []string) {
-	log("modifier: " + modifier)
+func (t *udt) addModifierToData(data map[string]interface{}, modifier string, values []string, logger Logger) {
+	if logger != nil {
+		log(logger, "modifier: "+modifier)
+	}
 
 	modifierName := t.StringProps[modifier]
 	// if modifier is a scriptProp then use itself as the name
 	if modifierName == "" {
 		modifierName = modifier
 	}
-	t.HiddenProps = append(t.HiddenProps, modifier)
+	if !t.isHidden(modifier) {
+		t.HiddenProps = append(t.HiddenProps, modifier)
+	}
 
-	log("addModifierToData: " + modifierName + " = [" + strings.Join(values, ", ") + "]")
+	if logger != nil {
+		log(logger, "addModifierToData: "+modifierName+" = ["+strings.Join(values, ", ")+"]")
+	}
 	appendValue := false
 	valueIsBool := false
 
@@ -245,7 +198,7 @@ func (t *udt) addModifierToData(data map[string]interface{}, modifier string, va
 		if data[modifierName] != nil { // determine if there is already a value for this modifier - if so then append
 			if data[modifierName] == "" { // TODO: why does this happen?
 				// don't append
-				log("Found empty value for modifier '" + modifierName + "'. This shouldn't happen")
+				log(logger, "Found empty value for modifier '"+modifierName+"'. This shouldn't happen")
 			} else {
 				appendValue = true
 				if _, ok := data[modifierName].([]interface{}); !ok { // if the value is not already a slice
@@ -276,6 +229,23 @@ func (t *udt) addModifierToData(data map[string]interface{}, modifier string, va
 
 }
 
+// isHidden returns true if the prop has been used as a modifier, so it is hidden from the final value.
+func (t *udt) isHidden(prop string) bool {
+	for _, hidden := range t.HiddenProps {
+		if hidden == prop {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a copy of the type. Props are shared because they don't change after the type is defined.
+func (t *udt) clone() *udt {
+	c := *t
+	c.HiddenProps = append([]string(nil), t.HiddenProps...)
+	return &c
+}
+
 func (t *udt) getModifiers() (all []string) {
 	for modifier := range t.StringProps {
 		all = append(all, modifier)
@@ -286,155 +256,189 @@ func (t *udt) getModifiers() (all []string) {
 	return all
 }
 
-// ParseUDT converts a string to a given UDT and then converts to JSON
-func ParseUDT(input string, t *udt, modifiers map[string][]string) interface{} {
-
-	unit := t.Unit
+// ParseUDT converts a UDT instance to a given UDT and then converts to JSON. Script props are run with the limits of
+// NewParser, and are nil if they fail.
+func ParseUDT(instance *UDTInstance, t *udt) interface{} {
+	value, _ := parseUDT(instance, t, NewParser().newRunner(), nil)
+	return value
+}
 
-	if t.isSpecial { // special type - convert to pure json
-		if unit == "json" {
-			data := t.Parse(input, modifiers)
-			if data["value"] != nil {
-				var valueData interface{}
-				if _, ok := data["value"].(string); !ok {
-					return data["value"] // don't need to parse non-strings
-				}
-				err := json.Unmarshal([]byte(data["value"].(string)), &valueData)
-				if err != nil {
-					data["value"] = nil
-					return data
-				}
-				return valueData
-			} else {
-				data["value"] = nil
-				return data
-			}
+// parseUDT converts a UDT instance like ParseUDT, running scripts with the runner. The errors are from script props
+// that failed - see udt.parse - or a value that couldn't be decoded.
+func parseUDT(instance *UDTInstance, t *udt, scripts *runner, source map[string]interface{}) (interface{}, []error) {
+	if t.decoder != nil { // pre-defined type like json - convert the value to data
+		return decodeValue(instance, t, scripts, source)
+	}
+	return t.parse(instance, scripts, source)
+}
 
-		} else {
-			//} else if unit == "yaml" {
+// registry holds the types that are known when lexing, and the lexer rules that depend on them.
+type registry struct {
+	UDTs map[string]*udt // stores user defined types
+	PDTs map[string]*udt // stores pre-defined types - these can change if user imports more types
+	// if dashAllowed is true, then '-' can be used to represent negative numbers in values and quantities (default behavior)
+	// if the user defines it as a type then dashAllowed will be set to false and '-' will only be treated as a udt.
+	// if '-' is used as a modifier at the same time as negative values, strange things will happen
+	dashAllowed bool
+	// if dotAllowed is true, then '.' can be used to represent decimal numbers (default behavior)
+	// if the user defines it as a type then dotAllowed will be set to false and '.' will only be treated as a udt.
+	// if '.' is used as a modifier, strange things will happen
+	dotAllowed bool
+	// if colonAllowed is true, then ':' can be used to start an unquoted value (default behavior)
+	// if the user defines it as a type or modifier then colonAllowed will be set to false and
+	// unquoted values will be disabled
+	colonAllowed bool
+	// tries of the units of the UDTs and PDTs, for finding the longest unit at the start of a word. They are
+	// built when needed and set to nil when types are added. Once built they don't change, so clones can share them.
+	udtUnits *trie
+	pdtUnits *trie
+	// transforms are run on the output once the whole document has been parsed, in the order they were defined
+	transforms []*transform
+	// the absolute paths of the files that have been imported, so they're only imported once, and of the files
+	// being imported, to find import cycles
+	imported  map[string]bool
+	importing []string
+	// a clone shares the maps of types and imported files, and the types, with the registry it was cloned from
+	// until it needs to change them - see own and ownType
+	cloned bool
+	shared bool          // the maps are still shared
+	copies map[*udt]*udt // the types that belong to the clone, by the shared type they were copied from
+}
 
-			data := t.Parse(input, modifiers)
-			if data["value"] != nil {
+// newRegistry returns a registry containing only the built-in types.
+func newRegistry() *registry {
+	r := &registry{
+		UDTs:         map[string]*udt{},
+		PDTs:         map[string]*udt{},
+		dashAllowed:  true,
+		dotAllowed:   true,
+		colonAllowed: true,
+		imported:     map[string]bool{},
+	}
+	r.defineBuiltInTypes()
+	r.units()
+	return r
+}
 
-				if _, ok := data["value"].(string); !ok {
-					return data // don't need to parse non-strings
-				}
-				var valueData interface{}
-				err := yaml.Unmarshal([]byte(data["value"].(string)), &valueData)
-				if err != nil {
-					data["value"] = nil
-					return data
-				}
-				valueData = convert(valueData)
-				return valueData
-			} else {
-				data["value"] = nil
-				return data
-			}
-		}
+// addUDT adds a user defined type, replacing any type with the same unit.
+func (r *registry) addUDT(t *udt) {
+	r.own()
+	if r.cloned {
+		r.copies[t] = t // types added to a clone are its own
+	}
+	if old, ok := r.UDTs[t.Unit]; ok {
+		t.replaces = old.origin
+	}
+	r.UDTs[t.Unit] = t
+	r.udtUnits = nil
+}
 
-	} else {
-		return t.Parse(input, modifiers)
+// defineUDT adds a user defined type, and if its unit is a special character then updates the rules of the lexer.
+func (r *registry) defineUDT(t *udt) {
+	r.addUDT(t)
+	switch t.Unit {
+	case "-":
+		r.dashAllowed = false
+	case ".":
+		r.dotAllowed = false
+	case ":":
+		r.colonAllowed = false
 	}
 }
 
-func (l *lexer) defineBuiltInTypes() { // these are handled differently
-	l.PDTs["json"] = NewUDT("json", map[string]float64{}, map[string]string{}, map[string]string{}, false)
-	l.PDTs["json"].isSpecial = true
-	l.PDTs["yaml"] = NewUDT("yaml", map[string]float64{}, map[string]string{}, map[string]string{}, false)
-	l.PDTs["yaml"].isSpecial = true
-	l.PDTs["md"] = NewUDT("md", map[string]float64{}, map[string]string{"type": "markdown"}, map[string]string{}, false)
+// addPDT adds a pre-defined type, replacing any type with the same unit.
+func (r *registry) addPDT(t *udt) {
+	r.own()
+	if r.cloned {
+		r.copies[t] = t // types added to a clone are its own
+	}
+	if old, ok := r.PDTs[t.Unit]; ok {
+		t.replaces = old.origin
+	}
+	r.PDTs[t.Unit] = t
+	r.pdtUnits = nil
 }
 
-func (l *lexer) defineImportedTypes(collectionName string) {
-
-	if collectionName == "si" {
-		log("Importing SI Units")
-
-		SITypes := []string{
-			"g,gram,weight",
-			"kg,kilogram,weight",
-			"s,second,time",
-			"min,minute,time",
-			"h,hour,time",
-			"d,day,time",
-			"m,metre,length",
-			"km,kilometre,length",
-			"au,astronomical unit,length",
-			"l,litre,volume",
-			"K,kelvin,temperature",
-			"A,ampere,electric current",
-			"mol,mole,amount of substance",
-			"cd,candela,luminous intensity",
-			"rad,radian,plane angle",
-			"sr,steradian,solid angle",
-			"Hz,hertz,frequency",
-			"N,newton,force",
-			"Pa,pascal,pressure",
-			"J,joule,energy",
-			"eV,electron volt,energy",
-			"W,watt,power",
-			"C,coulomb,electric charge",
-			"V,volt,voltage",
-			"F,farad,capacitance",
-			"Ω,ohm,resistance",
-			"S,siemens,electrical conductance",
-			"Wb,weber,magnetic flux",
-			"T,tesla,magnetic flux density",
-			"H,henry,inductance",
-			"°C,Celsius,temperature",
-			"lm,lumen,luminous flux",
-			"lx,lux,illuminance",
-			"Bq,becquerel,radioactivity",
-			"Gy,gray,absorbed dose",
-			"Sv,sievert,equivalent dose",
-			"kat,katal,catalytic activity",
+// units returns the tries of the units of the UDTs and PDTs, building them if types have been added.
+func (r *registry) units() (udtUnits *trie, pdtUnits *trie) {
+	if r.udtUnits == nil {
+		r.udtUnits = newTrie()
+		for unit := range r.UDTs {
+			r.udtUnits.insert(unit)
 		}
-
-		for _, t := range SITypes {
-			def := strings.SplitN(t, ",", 3)
-			l.PDTs[def[0]] = NewUDT(def[0], map[string]float64{}, map[string]string{"unit": def[1], "type": def[2]},
-				map[string]string{}, false)
+	}
+	if r.pdtUnits == nil {
+		r.pdtUnits = newTrie()
+		for unit := range r.PDTs {
+			r.pdtUnits.insert(unit)
 		}
 	}
+	return r.udtUnits, r.pdtUnits
+}
 
-	//Quantity	Name	Symbol	Value in SI units
-	//plane and
-	//phase angle	degree	°	1° = (π/180) rad
-	//minute	′	1′ = (1/60)° = (π/10800) rad
-	//second	″	1″ = (1/60)′ = (π/648000) rad
-	//area	hectare	ha	1 ha = 1 hm2 = 104 m2
-	//mass	tonne (metric ton)	t	1 t = 1 000 kg
-	//dalton	Da	1 Da = 1.660539040(20)×10−27 kg
-	//bel	B
-	//decibel	dB
-
-	if collectionName == "currency" || collectionName == "money" {
-		currencyTypes := []string{
-			"$,USD,United States dollar",
-			"£,GBP,British pound",
-			"€,EUR,Euro",
-			"¥,JPY,Japanese yen",
-			"円,Japanese yen",
-			"元,Chinese renminbi yuan",
-			"₹,Indian rupee",
-			"₽,RUB,Russian ruble",
-			"฿,Thai baht",
-
-			// crypto
-			"₿,BTC,Bitcoin",
-			"ETH,Ether",
-			"Ł,LTE,Litecoin",
-			"₳,ADA,Ada",
-		}
-		for _, t := range currencyTypes {
-			def := strings.Split(t, ",")
-			for _, unit := range def[:len(def)-1] {
-				l.PDTs[unit] = NewUDT(unit, map[string]float64{}, map[string]string{"unit": def[len(def)-1], "type": "money"},
-					map[string]string{}, false)
-			}
+// clone returns a copy of the registry that can be changed without affecting the original. The copy shares the
+// original's types until it changes them, so cloning is cheap when the input doesn't define or import anything.
+func (r *registry) clone() *registry {
+	c := *r
+	c.cloned = true
+	c.shared = true
+	c.copies = nil
+	c.transforms = r.transforms[:len(r.transforms):len(r.transforms)] // so appending to the clone doesn't change r
+	c.importing = nil
+	return &c
+}
+
+// own copies the maps of types and imported files if they're shared with the registry this was cloned from, so
+// that they can be changed.
+func (r *registry) own() {
+	if !r.shared {
+		if r.cloned && r.copies == nil {
+			r.copies = map[*udt]*udt{}
 		}
+		return
+	}
+	UDTs := make(map[string]*udt, len(r.UDTs))
+	for unit, t := range r.UDTs {
+		UDTs[unit] = t
+	}
+	PDTs := make(map[string]*udt, len(r.PDTs))
+	for unit, t := range r.PDTs {
+		PDTs[unit] = t
 	}
+	imported := make(map[string]bool, len(r.imported))
+	for path := range r.imported {
+		imported[path] = true
+	}
+	r.UDTs, r.PDTs, r.imported = UDTs, PDTs, imported
+	r.shared = false
+	r.copies = map[*udt]*udt{}
+}
+
+// ownType returns a version of a type that can be changed without changing the registry this was cloned from,
+// copying it if it's shared. Parsing changes a type's hidden props, which last for the rest of the input.
+func (r *registry) ownType(t *udt) *udt {
+	if !r.cloned {
+		return t
+	}
+	r.own()
+	if c, ok := r.copies[t]; ok {
+		return c
+	}
+	c := t.clone()
+	r.copies[t], r.copies[c] = c, c
+	if r.UDTs[t.Unit] == t {
+		r.UDTs[t.Unit] = c
+	} else if r.PDTs[t.Unit] == t {
+		r.PDTs[t.Unit] = c
+	}
+	return c
+}
+
+func (r *registry) defineBuiltInTypes() {
+	r.defineDecoderTypes()
+	md := NewUDT("md", map[string]float64{}, map[string]string{"type": "markdown"}, map[string]string{}, false)
+	md.origin = "pre-defined"
+	r.addPDT(md)
 }
 
 // return true if a rune could be the start of a udt - slightly faster than checking the whole thing
@@ -443,24 +447,8 @@ func (l *lexer) couldBeUDT(r rune) bool {
 		return true
 	}
 
-	i := 0
-	for k := range l.UDTs { // check UDTs first
-		log(string([]rune(k)[0]))
-		if r == []rune(k)[0] { // does the first rune in the UDT's unit match
-			log("could " + string(r) + " be a udt? yes!")
-			return true
-		}
-		i++
-	}
-	for k := range l.PDTs { // now check PDTs
-		log(string([]rune(k)[0]))
-		if r == []rune(k)[0] { // does the first rune in the UDT's unit match
-			log("could " + string(r) + " be a udt? actually it's a pdt!")
-			return true
-		}
-	}
-	log("could " + string(r) + " be a udt? no.")
-	return false
+	udtUnits, pdtUnits := l.units()
+	return udtUnits.hasPrefix(string(r)) || pdtUnits.hasPrefix(string(r))
 }
 
 // convert interface from yaml.Unmarshal to one that will work with json.Marshal
@@ -470,7 +458,7 @@ func convert(i interface{}) interface{} {
 	case map[interface{}]interface{}:
 		m2 := map[string]interface{}{}
 		for k, v := range x {
-			m2[k.(string)] = convert(v)
+			m2[fmt.Sprint(k)] = convert(v)
 		}
 		return m2
 	case []interface{}:
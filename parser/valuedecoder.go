@@ -0,0 +1,73 @@
+package parser
+
+import "sync"
+
+// ValueDecoder decodes the value of a pre-defined type into data, e.g. the value of json`{"a": 1}` into a map.
+// Register one with RegisterDecoder.
+type ValueDecoder interface {
+	DecodeValue(value string) (interface{}, error)
+}
+
+// DecoderFunc is a function that can be used as a ValueDecoder.
+type DecoderFunc func(value string) (interface{}, error)
+
+func (f DecoderFunc) DecodeValue(value string) (interface{}, error) {
+	return f(value)
+}
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = map[string]ValueDecoder{
+		"json": DecoderFunc(decodeJSON),
+		"yaml": DecoderFunc(decodeYAML),
+		"toml": DecoderFunc(decodeTOML),
+		"csv":  DecoderFunc(decodeCSV),
+		"xml":  DecoderFunc(decodeXML),
+		"ini":  DecoderFunc(decodeINI),
+	}
+)
+
+// RegisterDecoder adds a pre-defined type whose value is decoded into data by d, like json and yaml, e.g. so that
+// toml`a = 1` is converted to {"a": 1}. It replaces any decoder already registered for the unit. Only Parsers
+// created afterwards have the type.
+//
+// Quantities and modifiers are ignored. Values that aren't strings, e.g. the 5 in toml5, are kept as they are,
+// a type without a value is converted to an object with a null value, and a value that can't be decoded is
+// converted to a *DecodeError.
+func RegisterDecoder(unit string, d ValueDecoder) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders[unit] = d
+}
+
+// defineDecoderTypes adds a pre-defined type for each registered decoder.
+func (r *registry) defineDecoderTypes() {
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+	for unit, d := range decoders {
+		t := NewUDT(unit, map[string]float64{}, map[string]string{}, map[string]string{}, false)
+		t.decoder = d
+		t.origin = "pre-defined"
+		r.addPDT(t)
+	}
+}
+
+// decodeValue converts an instance of a type with a decoder to the data in its value.
+// If the value can't be decoded then it's converted to a *DecodeError, which is returned as the error too.
+func decodeValue(instance *UDTInstance, t *udt, scripts *runner, source map[string]interface{}) (interface{}, []error) {
+	data, _ := t.parse(instance, scripts, source) // pre-defined types don't have script props
+	switch value := data["value"].(type) {
+	case nil:
+		data["value"] = nil
+		return data, nil
+	case string:
+		decoded, err := t.decoder.DecodeValue(value)
+		if err != nil {
+			e := &DecodeError{Type: "error", Unit: t.Unit, Value: value, Message: err.Error()}
+			return e, []error{e}
+		}
+		return decoded, nil
+	default:
+		return value, nil // don't need to decode non-strings
+	}
+}